@@ -3,8 +3,11 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 
 	"go-mod.ewintr.nl/henk/agent/llm"
 	"go-mod.ewintr.nl/henk/agent/tool"
@@ -15,126 +18,219 @@ type Agent struct {
 	selectedProvider string
 	selectedModel    string
 	llmClient        llm.LLM
+	params           llm.Params
 	tools            []tool.Tool
-	conversation     []llm.Message
-	out              chan Message
-	in               chan string
+	session          *Session
+	conversation     *Conversation
+	ui               UI
 	done             bool
+	usage            llm.Usage
+	pendingImages    []llm.ContentBlock
+	approvalMu       sync.Mutex
+	approved         map[string]bool
 	ctx              context.Context
 }
 
-func New(ctx context.Context, config Config, llmClient llm.LLM, tools []tool.Tool, out chan Message, in chan string) *Agent {
-	return &Agent{
-		config:       config,
-		llmClient:    llmClient,
-		tools:        tools,
-		conversation: make([]llm.Message, 0),
-		out:          out,
-		in:           in,
-		ctx:          ctx,
+func New(ctx context.Context, config Config, llmClient llm.LLM, tools []tool.Tool, ui UI) *Agent {
+	uiStarted.Store(true)
+	a := &Agent{
+		config: config,
+		tools:  tools,
+		ui:     ui,
+		ctx:    ctx,
 	}
+	prov, _, _ := llmClient.ModelInfo()
+	provider, _ := config.Provider(prov)
+	a.llmClient = a.withRetry(llmClient, provider)
+	a.setSession(NewSession())
+
+	return a
 }
 
 func (a *Agent) Run() error {
-	// ui sends signal when started
-	<-a.in
 	go a.converse()
 
 	<-a.ctx.Done()
 	return nil
 }
 
+// converse runs until the user quits. Inference and tools use the context
+// of the agent, so that quitting also stops them.
 func (a *Agent) converse() error {
-	ctx := context.Background()
+	ctx := a.ctx
 
-	a.out <- Message{
-		Type: TypeGeneral,
-		Body: "Chat with Henk (use '/help' for help, '/quit' to quit)",
-	}
+	a.displayGen("Chat with Henk (use '/help' for help, '/quit' to quit)")
+	a.updateStatus()
 
 	readUserInput := true
+	failedRounds := 0
+	budget := newBudget(a.config.Tools)
 	for {
 		if a.done {
 			return nil
 		}
 		if readUserInput {
-			a.out <- Message{Type: TypePrompt}
-			userInput := <-a.in
-			if strings.HasPrefix(userInput, "/") {
-				a.runCommand(userInput)
-				continue
+			userInput, ok := a.ui.Prompt("")
+			if !ok {
+				a.quit()
+				return nil
 			}
-
-			userMessage := llm.Message{
-				Role: llm.RoleUser,
-				Content: []llm.ContentBlock{{
-					Text: userInput,
-					Type: llm.ContentTypeText,
-				}},
+			if strings.HasPrefix(userInput, "/") {
+				if infer := a.runCommand(userInput); !infer {
+					continue
+				}
+			} else {
+				msg := userMessage(userInput)
+				msg.Content = append(msg.Content, a.takeImages()...)
+				a.appendMessage(msg)
 			}
-			a.conversation = append(a.conversation, userMessage)
+			failedRounds = 0
+			budget = newBudget(a.config.Tools)
 		}
 
-		message, err := a.llmClient.RunInference(ctx, a.tools, a.conversation)
+		message, err := a.infer(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
-			a.out <- Message{Type: TypeError, Body: err.Error()}
+			a.displayError(err.Error())
+			readUserInput = true
 			continue
 		}
 
-		a.conversation = append(a.conversation, message)
-		toolResults := make([]llm.Message, 0)
+		a.appendMessage(message)
+		a.usage = message.Usage
+		a.updateStatus()
+		toolUses := make([]llm.ToolUse, 0)
 		for _, content := range message.Content {
 			switch content.Type {
-			case "text":
-				a.out <- Message{Type: TypeHenk, Body: content.Text}
-			case "tool_use":
-				toolResult := a.executeTool(content.ToolUse.ID, content.ToolUse.Name, content.ToolUse.Input)
-				if toolResult.Error {
-					a.out <- Message{
-						Type: TypeError,
-						Body: fmt.Sprintf("tool returned error, not adding to the conversation: %v", toolResult.Result),
-					}
-					continue
+			case llm.ContentTypeText:
+				a.ui.Show(Message{Type: TypeHenk, Body: content.Text})
+			case llm.ContentTypeThinking:
+				body := content.Thinking.Text
+				if body == "" {
+					body = "(redacted)"
 				}
-				toolResults = append(toolResults, llm.Message{
-					Role: llm.RoleUser,
-					Content: []llm.ContentBlock{{
-						Type:       llm.ContentTypeToolResult,
-						ToolResult: toolResult,
-					}},
-				})
+				a.ui.Show(Message{Type: TypeThinking, Body: body})
+			case llm.ContentTypeToolUse:
+				toolUses = append(toolUses, content.ToolUse)
 			}
 		}
-		if len(toolResults) == 0 {
+		if len(toolUses) == 0 {
 			readUserInput = true
 			continue
 		}
 
+		// every call gets a result, failed calls too, so that the model can
+		// correct itself
+		results := a.executeTools(ctx, toolUses)
+		toolResults := make([]llm.ContentBlock, 0, len(toolUses))
+		failed := true
+		for _, toolResult := range results {
+			if toolResult.Error {
+				a.displayError(fmt.Sprintf("tool returned error: %v", toolResult.Result))
+			} else {
+				failed = false
+			}
+			toolResults = append(toolResults, llm.ContentBlock{
+				Type:       llm.ContentTypeToolResult,
+				ToolResult: toolResult,
+			})
+		}
+
+		// all results of a turn go back in one message
 		readUserInput = false
-		a.conversation = append(a.conversation, toolResults...)
+		a.appendMessage(llm.Message{
+			Role:    llm.RoleUser,
+			Content: toolResults,
+		})
+		// the results of stopped calls are stored too, so that the session
+		// can be resumed
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if !failed {
+			failedRounds = 0
+		} else {
+			failedRounds++
+		}
+		if failedRounds >= max(a.config.Tools.MaxFailedRounds, 1) {
+			a.displayError(fmt.Sprintf("stopped after %d rounds of failing tool calls", failedRounds))
+			readUserInput = true
+			continue
+		}
+
+		if reason := budget.add(toolUses, results); reason != "" {
+			choice, ok := a.choose(fmt.Sprintf("Stopped because %s. Continue?", reason), []string{"yes", "no"})
+			switch {
+			case !ok:
+				a.quit()
+				return nil
+			case choice == 0:
+				budget = newBudget(a.config.Tools)
+			default:
+				readUserInput = true
+			}
+		}
 	}
 }
 
-func (a *Agent) executeTool(id, name string, input json.RawMessage) llm.ToolResult {
-	var t tool.Tool
-	var found bool
-	for _, i := range a.tools {
-		if i.Name() == name {
-			t = i
-			found = true
-			break
-		}
+// choose asks the user to pick one of the options. The answer can be the
+// number of the option, or the start of its text. It returns false if the
+// user wants to quit.
+func (a *Agent) choose(question string, options []string) (int, bool) {
+	list := make([]string, 0, len(options))
+	for i, o := range options {
+		list = append(list, fmt.Sprintf("%d. %s", i+1, o))
 	}
-	if !found {
-		return llm.ToolResult{
-			ID:     id,
-			Result: "tool not found",
-			Error:  true,
+	a.displayGen(fmt.Sprintf("%s\n\n%s", question, strings.Join(list, "\n")))
+
+	for {
+		answer, ok := a.ui.Prompt("")
+		if !ok {
+			return 0, false
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(options) {
+			return n - 1, true
 		}
+		if answer != "" {
+			for i, o := range options {
+				if strings.HasPrefix(strings.ToLower(o), answer) {
+					return i, true
+				}
+			}
+		}
+		a.displayError(fmt.Sprintf("please answer with a number from 1 to %d", len(options)))
 	}
-	a.out <- Message{Type: TypeTool, Body: fmt.Sprintf("%s(%s)", name, input)}
-	response, err := t.Execute(input)
-	if err != nil {
+}
+
+// executeTools runs the tool calls of one assistant message concurrently, with
+// at most MaxParallel at the same time. The results are returned in the order
+// of the calls.
+func (a *Agent) executeTools(ctx context.Context, toolUses []llm.ToolUse) []llm.ToolResult {
+	results := make([]llm.ToolResult, len(toolUses))
+	sem := make(chan struct{}, max(a.config.Tools.MaxParallel, 1))
+	var wg sync.WaitGroup
+	for i, tu := range toolUses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = a.executeTool(ctx, tu.ID, tu.Name, tu.Input)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (a *Agent) executeTool(ctx context.Context, id, name string, input json.RawMessage) llm.ToolResult {
+	a.ui.Show(Message{Type: TypeTool, ID: id, Body: formatToolCall(name, input)})
+	fail := func(err error) llm.ToolResult {
+		a.ui.Show(Message{Type: TypeToolResult, ID: id, Body: fmt.Sprintf("error: %v", err)})
 		return llm.ToolResult{
 			ID:     id,
 			Result: err.Error(),
@@ -142,16 +238,214 @@ func (a *Agent) executeTool(id, name string, input json.RawMessage) llm.ToolResu
 		}
 	}
 
+	var t tool.Tool
+	names := make([]string, 0, len(a.tools))
+	for _, i := range a.tools {
+		if i.Name() == name {
+			t = i
+		}
+		names = append(names, i.Name())
+	}
+	if t == nil {
+		return fail(fmt.Errorf("tool %q not found, available tools are: %s", name, strings.Join(names, ", ")))
+	}
+
+	err := tool.Validate(t.InputSchema(), input)
+	if err == nil {
+		err = a.approve(name, input)
+	}
+	var output tool.Output
+	if err == nil {
+		output, err = a.runTool(ctx, t, input)
+	}
+	if errors.Is(err, tool.ErrInvalidInput) {
+		schema, _ := json.Marshal(t.InputSchema())
+		return fail(fmt.Errorf("%v, the input must match the schema %s", err, schema))
+	}
+	if err != nil {
+		return fail(err)
+	}
+	a.ui.Show(Message{Type: TypeToolResult, ID: id, Body: output.Text})
+
+	images := make([]llm.Image, 0, len(output.Images))
+	for _, img := range output.Images {
+		images = append(images, llm.Image{MediaType: img.MediaType, Data: img.Data})
+	}
+
 	return llm.ToolResult{
 		ID:     id,
-		Result: response,
+		Result: output.Text,
+		Images: images,
+	}
+}
+
+// runTool executes the tool with the configured timeout. A tool that does not
+// stop when its context is done is abandoned. Tools that can return images
+// only do so when the current model can look at them.
+func (a *Agent) runTool(ctx context.Context, t tool.Tool, input json.RawMessage) (tool.Output, error) {
+	if timeout := a.config.Tools.TimeoutFor(t.Name()); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	execute := func() (tool.Output, error) {
+		response, err := t.Execute(ctx, input)
+		return tool.Output{Text: response}, err
+	}
+	if it, ok := t.(tool.ImageExecutor); ok && a.llmClient != nil {
+		if prov, mod, _ := a.llmClient.ModelInfo(); a.checkVision(prov, mod) == nil {
+			execute = func() (tool.Output, error) { return it.ExecuteImages(ctx, input) }
+		}
+	}
+
+	type result struct {
+		output tool.Output
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := execute()
+		done <- result{output, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.output, r.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return tool.Output{}, fmt.Errorf("tool %s timed out", t.Name())
+		}
+		return tool.Output{}, ctx.Err()
+	}
+}
+
+// infer asks the current model for an answer. When that fails because the
+// provider is down, overloaded or can not be reached, after the retries, the
+// models in the fallback list are tried in order. The first one that answers
+// becomes the current model. Errors in the request, like a bad key or a
+// conversation that is too long, are returned as they are, as another model
+// would hide them. The conversation does not need to change, every client
+// converts it to the format of its provider.
+func (a *Agent) infer(ctx context.Context) (llm.Message, error) {
+	images := hasImages(a.conversation.Messages())
+	prov, mod, _ := a.llmClient.ModelInfo()
+	if images {
+		if err := a.checkVision(prov, mod); err != nil {
+			return llm.Message{}, err
+		}
+	}
+	message, err := a.llmClient.RunInference(ctx, a.tools, a.conversation.Messages())
+	if err == nil || ctx.Err() != nil || !llm.Transient(err) {
+		return message, err
+	}
+
+	tried := map[string]bool{modelKey(prov, mod): true}
+	for _, f := range a.config.Fallbacks {
+		provider, ok := a.config.Provider(f.Provider)
+		if !ok {
+			continue
+		}
+		m, ok := provider.Model(f.Model)
+		if !ok || tried[modelKey(provider.Name, m.Name)] {
+			continue
+		}
+		if images && a.checkVision(provider.Name, m.Name) != nil {
+			continue
+		}
+		tried[modelKey(provider.Name, m.Name)] = true
+
+		client, cErr := a.newClient(provider, m.Name)
+		if cErr != nil {
+			a.displayError(fmt.Sprintf("could not create fallback %s: %s: %v", provider.Name, m.Name, cErr))
+			continue
+		}
+		a.displayError(fmt.Sprintf("%s: %s failed: %v", prov, mod, err))
+		a.displayGen(fmt.Sprintf("Switching to %s: %s", provider.Name, m.Name))
+		a.llmClient = client
+		a.updateStatus()
+
+		message, err = client.RunInference(ctx, a.tools, a.conversation.Messages())
+		if err == nil || ctx.Err() != nil || !llm.Transient(err) {
+			return message, err
+		}
+		prov, mod = provider.Name, m.Name
 	}
+
+	return llm.Message{}, err
+}
+
+func modelKey(provider, model string) string {
+	return provider + "/" + model
+}
+
+func (a *Agent) setSession(s *Session) {
+	a.session = s
+	a.conversation = s.Conversation
+	a.usage = llm.Usage{}
+	a.approved = make(map[string]bool)
+}
+
+// updateStatus sends the current model and the size of the context to the
+// status bar of the UI.
+func (a *Agent) updateStatus() {
+	prov, mod, short := a.llmClient.ModelInfo()
+	if short != "" {
+		mod = short
+	}
+	status := fmt.Sprintf("%s: %s | %d tokens", prov, mod, a.usage.Total())
+	if a.usage.CacheReadTokens > 0 {
+		status = fmt.Sprintf("%s (%d cached)", status, a.usage.CacheReadTokens)
+	}
+	a.ui.SetStatus(status)
+}
+
+func (a *Agent) quit() {
+	a.done = true
+	a.ui.Close()
+}
+
+func (a *Agent) appendMessage(msg llm.Message) {
+	id := a.conversation.Append(msg)
+	if msg.Role == llm.RoleAssistant {
+		prov, mod, _ := a.llmClient.ModelInfo()
+		a.conversation.Turns[id].Model = fmt.Sprintf("%s: %s", prov, mod)
+	}
+	a.saveSession()
+}
+
+func (a *Agent) saveSession() {
+	if err := a.session.Save(); err != nil {
+		a.displayError(fmt.Sprintf("could not save session: %v", err))
+	}
+}
+
+func formatToolCall(name string, input json.RawMessage) string {
+	return fmt.Sprintf("%s(%s)", name, input)
+}
+
+func userMessage(text string) llm.Message {
+	return llm.Message{
+		Role: llm.RoleUser,
+		Content: []llm.ContentBlock{{
+			Text: text,
+			Type: llm.ContentTypeText,
+		}},
+	}
+}
+
+// takeImages returns the images that wait for the next message.
+func (a *Agent) takeImages() []llm.ContentBlock {
+	images := a.pendingImages
+	a.pendingImages = nil
+
+	return images
 }
 
 func (a *Agent) displayError(msg string) {
-	a.out <- Message{Type: TypeError, Body: msg}
+	a.ui.Show(Message{Type: TypeError, Body: llm.Redact(msg)})
 }
 
 func (a *Agent) displayGen(msg string) {
-	a.out <- Message{Type: TypeGeneral, Body: msg}
+	a.ui.Show(Message{Type: TypeGeneral, Body: msg})
 }
@@ -0,0 +1,1131 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/invopop/jsonschema"
+	"go-mod.ewintr.nl/henk/agent/llm"
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+// testUI plays the role of the user by answering prompts from a script. When
+// the script runs out, the user quits.
+type testUI struct {
+	prompts []string
+	shown   []Message
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+}
+
+func (ui *testUI) Show(msg Message) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.shown = append(ui.shown, msg)
+}
+
+func (ui *testUI) Prompt(initial string) (string, bool) {
+	if len(ui.prompts) == 0 {
+		return "", false
+	}
+	p := ui.prompts[0]
+	ui.prompts = ui.prompts[1:]
+
+	return p, true
+}
+
+// Edit plays the user writing the next prompt in the editor.
+func (ui *testUI) Edit(text string) (string, error) {
+	p, ok := ui.Prompt(text)
+	if !ok {
+		return "", errors.New("no edit in the script")
+	}
+
+	return p, nil
+}
+
+func (ui *testUI) SetStatus(status string) {}
+func (ui *testUI) Close()                  { ui.cancel() }
+
+func (ui *testUI) bodies(t MessageType) []string {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	bodies := make([]string, 0)
+	for _, msg := range ui.shown {
+		if msg.Type == t {
+			bodies = append(bodies, msg.Body)
+		}
+	}
+
+	return bodies
+}
+
+var testToolsConfig = ToolsConfig{MaxParallel: 4, MaxFailedRounds: 3, MaxRepeats: 3}
+
+// runAgent lets the agent converse with the replay provider until the
+// prompts are used up.
+func runAgent(t *testing.T, fixture string, prompts ...string) (*Agent, *testUI) {
+	t.Helper()
+
+	return runAgentWithTools(t, testToolsConfig, fixture, prompts...)
+}
+
+func runAgentWithTools(t *testing.T, toolsConfig ToolsConfig, fixture string, prompts ...string) (*Agent, *testUI) {
+	t.Helper()
+
+	provider := llm.Provider{
+		Type:    "replay",
+		Name:    "replay",
+		Fixture: fixture,
+		Models:  []llm.Model{{Name: "fake"}},
+	}
+	config := Config{
+		Providers: []llm.Provider{provider},
+		Tools:     toolsConfig,
+	}
+
+	return runAgentWithConfig(t, config, prompts...)
+}
+
+// runAgentWithConfig starts with the first model of the first provider.
+func runAgentWithConfig(t *testing.T, config Config, prompts ...string) (*Agent, *testUI) {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	provider := config.Providers[0]
+	client, err := llm.NewLLM(provider, provider.Models[0].Name, "")
+	if err != nil {
+		t.Fatalf("could not create llm: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ui := &testUI{prompts: prompts, cancel: cancel}
+	tools := []tool.Tool{tool.NewReadFile(), tool.NewListFiles()}
+
+	a := New(ctx, config, client, tools, ui)
+	if err := a.Run(); err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	return a, ui
+}
+
+func TestConverseToolUse(t *testing.T) {
+	a, ui := runAgent(t, "testdata/read_file.json", "what is in my notes?")
+
+	if errs := ui.bodies(TypeError); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	// the calls run concurrently, so they can be shown in any order
+	calls := ui.bodies(TypeTool)
+	slices.Sort(calls)
+	if len(calls) != 2 || !strings.HasPrefix(calls[0], "list_files(") || !strings.HasPrefix(calls[1], "read_file(") {
+		t.Errorf("expected read_file and list_files calls, got %v", calls)
+	}
+	exp := []string{"Let me look at that file.", "It reminds you to water the plants."}
+	if act := ui.bodies(TypeHenk); strings.Join(act, "|") != strings.Join(exp, "|") {
+		t.Errorf("expected answers %v, got %v", exp, act)
+	}
+
+	msgs := a.conversation.Messages()
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(msgs))
+	}
+	results := msgs[2].Content
+	if len(results) != 2 {
+		t.Fatalf("expected both tool results in one message, got %+v", results)
+	}
+	for i, id := range []string{"call_1", "call_2"} {
+		if results[i].Type != llm.ContentTypeToolResult || results[i].ToolResult.ID != id {
+			t.Errorf("expected tool result for %s, got %+v", id, results[i])
+		}
+	}
+	if !strings.Contains(results[0].ToolResult.Result, "water the plants") {
+		t.Errorf("expected file contents in tool result, got %q", results[0].ToolResult.Result)
+	}
+	if !strings.Contains(results[1].ToolResult.Result, "notes.txt") {
+		t.Errorf("expected file listing in tool result, got %q", results[1].ToolResult.Result)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		prompts  []string
+		expTexts []string
+		expTurns int
+	}{
+		{
+			name:     "undo",
+			prompts:  []string{"one", "/undo"},
+			expTexts: []string{},
+			expTurns: 2,
+		},
+		{
+			name:     "retry",
+			prompts:  []string{"one", "/retry"},
+			expTexts: []string{"one", "second answer"},
+			expTurns: 3,
+		},
+		{
+			name:     "branch",
+			prompts:  []string{"one", "two", "/branch", "three"},
+			expTexts: []string{"one", "first answer", "three", "third answer"},
+			expTurns: 6,
+		},
+		{
+			name:     "checkout",
+			prompts:  []string{"one", "two", "/branch", "three", "/checkout 2"},
+			expTexts: []string{"one", "first answer", "two", "second answer"},
+			expTurns: 6,
+		},
+		{
+			name:     "edit",
+			prompts:  []string{"one", "/edit", "uno"},
+			expTexts: []string{"uno", "second answer"},
+			expTurns: 4,
+		},
+		{
+			name:     "clear",
+			prompts:  []string{"one", "/clear"},
+			expTexts: []string{},
+			expTurns: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, ui := runAgent(t, "testdata/answers.json", tc.prompts...)
+
+			if errs := ui.bodies(TypeError); len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			texts := make([]string, 0)
+			for _, msg := range a.conversation.Messages() {
+				texts = append(texts, messageText(msg))
+			}
+			if strings.Join(texts, "|") != strings.Join(tc.expTexts, "|") {
+				t.Errorf("expected conversation %v, got %v", tc.expTexts, texts)
+			}
+			if len(a.conversation.Turns) != tc.expTurns {
+				t.Errorf("expected %d turns in the tree, got %d", tc.expTurns, len(a.conversation.Turns))
+			}
+		})
+	}
+}
+
+func TestSetParams(t *testing.T) {
+	a, ui := runAgent(t, "testdata/answers.json",
+		"/set temperature 0.3",
+		"/set stop END ###",
+		"/set temperature hot",
+		"/set stop",
+		"/set",
+	)
+
+	if errs := ui.bodies(TypeError); len(errs) != 1 || !strings.Contains(errs[0], "invalid value for temperature") {
+		t.Errorf("expected an error for the invalid value, got %v", errs)
+	}
+	if a.params.Temperature == nil || *a.params.Temperature != 0.3 || a.params.Stop != nil {
+		t.Errorf("expected only temperature to be set, got %s", a.params)
+	}
+	gen := ui.bodies(TypeGeneral)
+	if last := gen[len(gen)-1]; !strings.HasSuffix(last, "temperature = 0.3") {
+		t.Errorf("expected the parameters to be listed, got %q", last)
+	}
+}
+
+func TestUnknownTool(t *testing.T) {
+	_, ui := runAgent(t, "testdata/unknown_tool.json", "do something")
+
+	errs := ui.bodies(TypeError)
+	if len(errs) != 4 {
+		t.Fatalf("expected three failed calls and a stop, got %v", errs)
+	}
+	if !strings.Contains(errs[0], `"write_file" not found, available tools are: read_file, list_files`) {
+		t.Errorf("expected list of available tools, got %q", errs[0])
+	}
+	if !strings.Contains(errs[3], "stopped after 3 rounds") {
+		t.Errorf("expected loop to stop, got %q", errs[3])
+	}
+}
+
+func TestThinking(t *testing.T) {
+	a, ui := runAgent(t, "testdata/thinking.json", "hi")
+
+	exp := []string{"The user says hi, so I say hi back.", "(redacted)"}
+	if act := ui.bodies(TypeThinking); strings.Join(act, "|") != strings.Join(exp, "|") {
+		t.Errorf("expected thinking %v, got %v", exp, act)
+	}
+	if act := ui.bodies(TypeHenk); len(act) != 1 || act[0] != "Hi!" {
+		t.Errorf("expected the answer, got %v", act)
+	}
+	// signed thinking is kept, so that it can be sent back
+	msgs := a.conversation.Messages()
+	if th := msgs[len(msgs)-1].Content[0].Thinking; th.Signature != "sig" {
+		t.Errorf("expected the signature to be stored, got %+v", th)
+	}
+}
+
+func TestImage(t *testing.T) {
+	dir := t.TempDir()
+	png := filepath.Join(dir, "screen.png")
+	if err := os.WriteFile(png, []byte("\x89PNG\r\n\x1a\nrest of the image"), 0o644); err != nil {
+		t.Fatalf("could not write image: %v", err)
+	}
+	notes := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(notes, []byte("just text"), 0o644); err != nil {
+		t.Fatalf("could not write notes: %v", err)
+	}
+
+	t.Run("attach", func(t *testing.T) {
+		a, ui := runAgent(t, "testdata/answers.json",
+			"/image "+png,
+			"/image "+notes,
+			"what is this?",
+			"/image "+png+" and this?",
+		)
+
+		if errs := ui.bodies(TypeError); len(errs) != 1 || !strings.Contains(errs[0], "is not a png") {
+			t.Errorf("expected the text file to be refused, got %v", errs)
+		}
+		msgs := a.conversation.Messages()
+		if len(msgs) != 4 {
+			t.Fatalf("expected 4 messages, got %d", len(msgs))
+		}
+		for _, i := range []int{0, 2} {
+			content := msgs[i].Content
+			if len(content) != 2 || content[1].Type != llm.ContentTypeImage || content[1].Image.MediaType != "image/png" {
+				t.Errorf("expected message %d to have the question and the image, got %+v", i, content)
+			}
+		}
+	})
+
+	t.Run("edit", func(t *testing.T) {
+		a, ui := runAgent(t, "testdata/answers.json", "/image "+png+" what is this?", "/edit", "and what is this?")
+
+		if errs := ui.bodies(TypeError); len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		content := a.conversation.Messages()[0].Content
+		if len(content) != 2 || content[0].Text != "and what is this?" || content[1].Type != llm.ContentTypeImage {
+			t.Errorf("expected the edited question with the image, got %+v", content)
+		}
+	})
+
+	t.Run("no vision", func(t *testing.T) {
+		noVision := false
+		config := Config{
+			Providers: []llm.Provider{{
+				Type:    "replay",
+				Name:    "replay",
+				Fixture: "testdata/answers.json",
+				Models:  []llm.Model{{Name: "fake", Vision: &noVision}},
+			}},
+			Tools: testToolsConfig,
+		}
+		a, ui := runAgentWithConfig(t, config, "/image "+png+" what is this?")
+
+		if errs := ui.bodies(TypeError); len(errs) != 1 || !strings.Contains(errs[0], "can not look at images") {
+			t.Errorf("expected the image to be refused, got %v", errs)
+		}
+		if msgs := a.conversation.Messages(); len(msgs) != 0 {
+			t.Errorf("expected no messages, got %d", len(msgs))
+		}
+	})
+
+	t.Run("read file", func(t *testing.T) {
+		a, ui := runAgent(t, "testdata/read_image.json", "what is in screen.png?")
+
+		if errs := ui.bodies(TypeError); len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		msgs := a.conversation.Messages()
+		if len(msgs) != 4 {
+			t.Fatalf("expected 4 messages, got %d", len(msgs))
+		}
+		tr := msgs[2].Content[0].ToolResult
+		if tr.Error || len(tr.Images) != 1 || tr.Images[0].MediaType != "image/png" {
+			t.Errorf("expected the image in the tool result, got %+v", tr)
+		}
+	})
+
+	t.Run("read file without vision", func(t *testing.T) {
+		noVision := false
+		config := Config{
+			Providers: []llm.Provider{{
+				Type:    "replay",
+				Name:    "replay",
+				Fixture: "testdata/read_image.json",
+				Models:  []llm.Model{{Name: "fake", Vision: &noVision}},
+			}},
+			Tools: testToolsConfig,
+		}
+		a, _ := runAgentWithConfig(t, config, "what is in screen.png?")
+
+		msgs := a.conversation.Messages()
+		if len(msgs) != 4 {
+			t.Fatalf("expected 4 messages, got %d", len(msgs))
+		}
+		tr := msgs[2].Content[0].ToolResult
+		if !tr.Error || len(tr.Images) != 0 || !strings.Contains(tr.Result, "can only read text") {
+			t.Errorf("expected the image to be refused, got %+v", tr)
+		}
+	})
+}
+
+func TestFallback(t *testing.T) {
+	replay := func(name, fixture string) llm.Provider {
+		return llm.Provider{
+			Type:    "replay",
+			Name:    name,
+			Fixture: fixture,
+			Models:  []llm.Model{{Name: "fake"}},
+			Retry:   llm.RetryConfig{MaxAttempts: 1},
+		}
+	}
+	fallbacks := []Fallback{
+		{Provider: "down", Model: "fake"},
+		{Provider: "broken", Model: "fake"},
+		{Provider: "backup", Model: "fake"},
+	}
+
+	t.Run("provider down", func(t *testing.T) {
+		config := Config{
+			Providers: []llm.Provider{
+				replay("down", "testdata/unavailable.json"),
+				replay("broken", "testdata/unavailable.json"),
+				replay("backup", "testdata/answers.json"),
+			},
+			Tools:     testToolsConfig,
+			Fallbacks: fallbacks,
+		}
+		a, ui := runAgentWithConfig(t, config, "one", "/status")
+
+		errs := ui.bodies(TypeError)
+		if len(errs) != 2 || !strings.HasPrefix(errs[0], "down: fake failed") || !strings.HasPrefix(errs[1], "broken: fake failed") {
+			t.Errorf("expected the failures of both models, got %v", errs)
+		}
+		if act := ui.bodies(TypeHenk); len(act) != 1 || act[0] != "first answer" {
+			t.Errorf("expected the answer of the fallback, got %v", act)
+		}
+		if prov, _, _ := a.llmClient.ModelInfo(); prov != "backup" {
+			t.Errorf("expected to continue with backup, got %s", prov)
+		}
+		gen := ui.bodies(TypeGeneral)
+		if !slices.Contains(gen, "Switching to backup: fake") {
+			t.Errorf("expected the switch to be shown, got %v", gen)
+		}
+		if status := gen[len(gen)-1]; !strings.Contains(status, "Last answer by: backup: fake") {
+			t.Errorf("expected status to show the model that answered, got %q", status)
+		}
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		config := Config{
+			Providers: []llm.Provider{
+				replay("down", "testdata/bad_request.json"),
+				replay("broken", "testdata/unavailable.json"),
+				replay("backup", "testdata/answers.json"),
+			},
+			Tools:     testToolsConfig,
+			Fallbacks: fallbacks,
+		}
+		a, ui := runAgentWithConfig(t, config, "one")
+
+		// the request is wrong, another model would hide that
+		errs := ui.bodies(TypeError)
+		if len(errs) != 1 || !strings.Contains(errs[0], "prompt is too long") {
+			t.Errorf("expected only the error of the request, got %v", errs)
+		}
+		if prov, _, _ := a.llmClient.ModelInfo(); prov != "down" {
+			t.Errorf("expected to stay with down, got %s", prov)
+		}
+		if act := ui.bodies(TypeHenk); len(act) != 0 {
+			t.Errorf("expected no answer, got %v", act)
+		}
+	})
+}
+
+func TestToolErrorFeedback(t *testing.T) {
+	a, ui := runAgent(t, "testdata/tool_error.json", "what is in my notes?")
+
+	if act := ui.bodies(TypeHenk); len(act) != 1 || act[0] != "It reminds you to water the plants." {
+		t.Errorf("expected the model to recover, got %v", act)
+	}
+
+	msgs := a.conversation.Messages()
+	if len(msgs) != 8 {
+		t.Fatalf("expected 8 messages, got %d", len(msgs))
+	}
+	for _, tc := range []struct {
+		msg      int
+		expError bool
+		expText  string
+	}{
+		{msg: 2, expError: true, expText: "did you mean: testdata/notes.txt?"},
+		{msg: 4, expError: true, expText: "invalid input: path: expected string, got number, the input must match the schema"},
+		{msg: 6, expText: "water the plants"},
+	} {
+		tr := msgs[tc.msg].Content[0].ToolResult
+		if tr.Error != tc.expError || !strings.Contains(tr.Result, tc.expText) {
+			t.Errorf("message %d: expected error %v with %q, got %+v", tc.msg, tc.expError, tc.expText, tr)
+		}
+	}
+}
+
+func TestToolLoopLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		answer   string
+		expTexts []string
+		expTurns int
+	}{
+		{
+			name:     "stop",
+			answer:   "no",
+			expTexts: []string{},
+			expTurns: 7,
+		},
+		{
+			name:     "continue",
+			answer:   "1",
+			expTexts: []string{"Done."},
+			expTurns: 10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, ui := runAgent(t, "testdata/loop.json", "read my notes", tc.answer)
+
+			asked := 0
+			for _, b := range ui.bodies(TypeGeneral) {
+				if strings.HasPrefix(b, "Stopped because the model called read_file({\"path\":\"testdata/notes.txt\"}) 3 times. Continue?") {
+					asked++
+				}
+			}
+			if asked != 1 {
+				t.Errorf("expected to be asked once to continue, got %v", ui.bodies(TypeGeneral))
+			}
+			if act := ui.bodies(TypeHenk); strings.Join(act, "|") != strings.Join(tc.expTexts, "|") {
+				t.Errorf("expected answers %v, got %v", tc.expTexts, act)
+			}
+			if act := len(a.conversation.Messages()); act != tc.expTurns {
+				t.Errorf("expected %d messages, got %d", tc.expTurns, act)
+			}
+		})
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		policy      string
+		permissions map[string]Permission
+		prompts     []string
+		expAsked    int
+		expResults  []string
+	}{
+		{
+			name:       "allow by default",
+			expResults: []string{"water the plants", "notes.txt"},
+		},
+		{
+			name:        "deny",
+			permissions: map[string]Permission{"list_files": {Policy: PolicyDeny}},
+			expResults:  []string{"water the plants", "error: calling list_files with this input is not allowed"},
+		},
+		{
+			name:        "deny by pattern",
+			permissions: map[string]Permission{"read_file": {Deny: []string{"**/*.txt"}}},
+			expResults:  []string{"error: calling read_file with this input is not allowed", "notes.txt"},
+		},
+		{
+			name:   "allow by pattern",
+			policy: PolicyDeny,
+			permissions: map[string]Permission{
+				"read_file":  {Allow: []string{"testdata/*"}},
+				"list_files": {Allow: []string{"testdata/*"}},
+			},
+			expResults: []string{"water the plants", "error: calling list_files with this input is not allowed"},
+		},
+		{
+			name:       "ask and approve",
+			policy:     PolicyAsk,
+			prompts:    []string{"1", "y"},
+			expAsked:   2,
+			expResults: []string{"water the plants", "notes.txt"},
+		},
+		{
+			name:        "ask and deny with reason",
+			permissions: map[string]Permission{"read_file": {Policy: PolicyAsk}},
+			prompts:     []string{"no", "that is private"},
+			expAsked:    1,
+			expResults:  []string{"error: the user denied this call: that is private", "notes.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			toolsConfig := testToolsConfig
+			toolsConfig.Policy = tc.policy
+			toolsConfig.Permissions = tc.permissions
+			prompts := append([]string{"what is in my notes?"}, tc.prompts...)
+			a, ui := runAgentWithTools(t, toolsConfig, "testdata/read_file.json", prompts...)
+
+			asked := 0
+			for _, b := range ui.bodies(TypeGeneral) {
+				if strings.HasPrefix(b, "Henk wants to call") {
+					asked++
+				}
+			}
+			if asked != tc.expAsked {
+				t.Errorf("expected %d questions, got %d", tc.expAsked, asked)
+			}
+			msgs := a.conversation.Messages()
+			if len(msgs) != 4 {
+				t.Fatalf("expected 4 messages, got %d", len(msgs))
+			}
+			for i, exp := range tc.expResults {
+				tr := msgs[2].Content[i].ToolResult
+				act := tr.Result
+				if tr.Error {
+					act = "error: " + act
+				}
+				if !strings.Contains(act, exp) {
+					t.Errorf("result %d: expected %q, got %q", i, exp, act)
+				}
+			}
+		})
+	}
+}
+
+func TestPermissionPaths(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("could not get working directory: %v", err)
+	}
+	p := Permission{
+		Policy: PolicyAsk,
+		Allow:  []string{"**/*.go"},
+		Deny:   []string{".env", "**/*.key"},
+	}
+	for _, tc := range []struct {
+		path string
+		exp  string
+	}{
+		{path: ".env", exp: PolicyDeny},
+		{path: "./.env", exp: PolicyDeny},
+		{path: filepath.Join(wd, ".env"), exp: PolicyDeny},
+		{path: filepath.Join("..", filepath.Base(wd), ".env"), exp: PolicyDeny},
+		{path: "/etc/ssl/private/server.key", exp: PolicyDeny},
+		{path: "agent.go", exp: PolicyAllow},
+		{path: filepath.Join(wd, "llm", "llm.go"), exp: PolicyAllow},
+		{path: "../../elsewhere/x.go", exp: PolicyAsk},
+		{path: "/tmp/x.go", exp: PolicyAsk},
+		{path: "notes.txt", exp: PolicyAsk},
+	} {
+		input, _ := json.Marshal(map[string]string{"path": tc.path})
+		if act := p.decide(input); act != tc.exp {
+			t.Errorf("%s: expected %s, got %s", tc.path, tc.exp, act)
+		}
+	}
+}
+
+func TestApproveForSession(t *testing.T) {
+	toolsConfig := testToolsConfig
+	toolsConfig.Policy = PolicyAsk
+	_, ui := runAgentWithTools(t, toolsConfig, "testdata/loop.json", "read my notes", "2", "yes")
+
+	asked := 0
+	for _, b := range ui.bodies(TypeGeneral) {
+		if strings.HasPrefix(b, "Henk wants to call") {
+			asked++
+		}
+	}
+	if asked != 1 {
+		t.Errorf("expected to be asked once, got %d", asked)
+	}
+	if act := ui.bodies(TypeHenk); len(act) != 1 || act[0] != "Done." {
+		t.Errorf("expected all calls to be approved, got %v", act)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		exp     bool
+	}{
+		{pattern: "*.go", path: "main.go", exp: true},
+		{pattern: "*.go", path: "agent/agent.go", exp: false},
+		{pattern: "**/*.go", path: "main.go", exp: true},
+		{pattern: "**/*.go", path: "agent/llm/llm.go", exp: true},
+		{pattern: "docs/**", path: "docs/a/b.md", exp: true},
+		{pattern: "docs/**", path: "src/docs.md", exp: false},
+		{pattern: ".env", path: ".env", exp: true},
+		{pattern: "?.txt", path: "a.txt", exp: true},
+	} {
+		re, err := globRegexp(tc.pattern)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.pattern, err)
+		}
+		if act := re.MatchString(tc.path); act != tc.exp {
+			t.Errorf("%s on %s: expected %v, got %v", tc.pattern, tc.path, tc.exp, act)
+		}
+	}
+}
+
+// sleepTool waits for the given number of milliseconds, or until it is
+// cancelled.
+type sleepTool struct{}
+
+func (sleepTool) Name() string                    { return "sleep" }
+func (sleepTool) Description() string             { return "sleeps" }
+func (sleepTool) InputSchema() *jsonschema.Schema { return nil }
+func (sleepTool) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	var ms int
+	if err := json.Unmarshal(input, &ms); err != nil {
+		return "", err
+	}
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return string(input), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func TestExecuteTools(t *testing.T) {
+	ui := &testUI{}
+	a := &Agent{
+		ui:    ui,
+		tools: []tool.Tool{sleepTool{}},
+		config: Config{Tools: ToolsConfig{
+			MaxParallel: 3,
+			Timeout:     time.Second,
+			Timeouts:    map[string]time.Duration{"sleep": 200 * time.Millisecond},
+		}},
+	}
+	toolUses := make([]llm.ToolUse, 0)
+	for i, ms := range []string{"100", "50", "5000", "1", "100"} {
+		toolUses = append(toolUses, llm.ToolUse{ID: string(rune('a' + i)), Name: "sleep", Input: json.RawMessage(ms)})
+	}
+
+	start := time.Now()
+	results := a.executeTools(context.Background(), toolUses)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected calls to run concurrently, took %v", elapsed)
+	}
+
+	if len(results) != len(toolUses) {
+		t.Fatalf("expected %d results, got %d", len(toolUses), len(results))
+	}
+	for i, r := range results {
+		if r.ID != toolUses[i].ID {
+			t.Errorf("expected result %d to be for call %s, got %s", i, toolUses[i].ID, r.ID)
+		}
+		if i == 2 {
+			if !r.Error || !strings.Contains(r.Result, "timed out") {
+				t.Errorf("expected slow call to time out, got %+v", r)
+			}
+			continue
+		}
+		if r.Error || r.Result != string(toolUses[i].Input) {
+			t.Errorf("expected result %s, got %+v", toolUses[i].Input, r)
+		}
+	}
+	if done := ui.bodies(TypeToolResult); len(done) != len(toolUses) {
+		t.Errorf("expected progress for every call, got %v", done)
+	}
+}
+
+// quitTool quits the agent, the way a user does with ctrl-c, and waits until
+// it is stopped.
+type quitTool struct {
+	cancel context.CancelFunc
+}
+
+func (quitTool) Name() string                    { return "quit" }
+func (quitTool) Description() string             { return "quits" }
+func (quitTool) InputSchema() *jsonschema.Schema { return nil }
+func (qt quitTool) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	qt.cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		return "still running", nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func TestConverseQuit(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	provider := llm.Provider{
+		Type:    "replay",
+		Name:    "replay",
+		Fixture: "testdata/quit.json",
+		Models:  []llm.Model{{Name: "fake"}},
+	}
+	client, err := llm.NewLLM(provider, "fake", "")
+	if err != nil {
+		t.Fatalf("could not create llm: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ui := &testUI{prompts: []string{"quit", "are you still there?"}, cancel: cancel}
+	config := Config{Providers: []llm.Provider{provider}, Tools: testToolsConfig}
+	a := New(ctx, config, client, []tool.Tool{quitTool{cancel: cancel}}, ui)
+
+	start := time.Now()
+	a.converse()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the tool to be stopped, took %v", elapsed)
+	}
+	if len(ui.prompts) != 1 {
+		t.Errorf("expected the conversation to stop, got %d prompts left", len(ui.prompts))
+	}
+	msgs := a.conversation.Messages()
+	if len(msgs) != 3 || !msgs[2].Content[0].ToolResult.Error {
+		t.Errorf("expected the stopped call to have a result, got %+v", msgs)
+	}
+}
+
+func TestRemoteModelsAndDoctor(t *testing.T) {
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			writeJSON(w, map[string]any{"models": []map[string]any{{"name": "qwen3:32b"}, {"name": "gemma3:latest"}, {"name": "llama3:latest"}}})
+		case "/api/show":
+			var req struct {
+				Model string `json:"model"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			if !slices.Contains([]string{"qwen3:32b", "gemma3:latest", "llama3:latest"}, req.Model) {
+				w.WriteHeader(http.StatusNotFound)
+				writeJSON(w, map[string]any{"error": "model not found"})
+				return
+			}
+			writeJSON(w, map[string]any{
+				"model_info":   map[string]any{"qwen3.context_length": 40960},
+				"capabilities": []string{"completion", "tools"},
+			})
+		}
+	}))
+	defer ollama.Close()
+	openai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/models":
+			writeJSON(w, map[string]any{"data": []map[string]any{{"id": "gpt-x"}}})
+		case "/v1/chat/completions":
+			writeJSON(w, map[string]any{"choices": []map[string]any{{
+				"message": map[string]any{
+					"role": "assistant",
+					"tool_calls": []map[string]any{{
+						"id":       "call_1",
+						"type":     "function",
+						"function": map[string]any{"name": "list_files", "arguments": `{"path": "."}`},
+					}},
+				},
+			}}})
+		}
+	}))
+	defer openai.Close()
+
+	config := Config{Providers: []llm.Provider{
+		{Type: "ollama", Name: "ollama", BaseURL: ollama.URL, Models: []llm.Model{
+			{Name: "qwen3:32b", ContextSize: 50000},
+			{Name: "qwen3:23b"},
+			{Name: "gemma3"},
+		}},
+		{Type: "openai", Name: "router", BaseURL: openai.URL + "/v1", ApiKey: "key", Models: []llm.Model{{Name: "gpt-x"}}},
+		{Type: "replay", Name: "replay", Models: []llm.Model{{Name: "fake"}}},
+	}}
+
+	report := RemoteModels(context.Background(), config)
+	for _, exp := range []string{
+		"- qwen3:32b: available, context 40960, context_size 50000 is larger than the model supports, tools\n",
+		"- qwen3:23b: not offered by the provider\n",
+		"- gemma3: available, context 40960, tools\n",
+		"- not configured: llama3:latest\n",
+		"- gpt-x: available\n",
+		"could not list models",
+	} {
+		if !strings.Contains(report, exp) {
+			t.Errorf("expected report to contain %q, got:\n%s", exp, report)
+		}
+	}
+
+	var out strings.Builder
+	if Doctor(context.Background(), config, &out) {
+		t.Errorf("expected doctor to fail for the missing model")
+	}
+	for _, exp := range []string{
+		"  ok    connected, 3 models offered\n",
+		"  ok    qwen3:32b: supports tools\n",
+		"  FAIL  qwen3:23b: not offered by the provider\n",
+		"  ok    gemma3: supports tools\n",
+		"  ok    gpt-x: calls tools\n",
+		"  warn  this provider can not be checked\n",
+	} {
+		if !strings.Contains(out.String(), exp) {
+			t.Errorf("expected doctor output to contain %q, got:\n%s", exp, out.String())
+		}
+	}
+}
+
+func TestReadConfigKeys(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	if err := os.MkdirAll(filepath.Join(dir, "henk"), 0o755); err != nil {
+		t.Fatalf("could not create config dir: %v", err)
+	}
+	cfg := `
+[[providers]]
+type = "openai"
+name = "unused"
+api_key_env = "HENK_TEST_MISSING_KEY"
+
+  [[providers.models]]
+  name = "gpt"
+
+[[providers]]
+type = "openai"
+name = "stored"
+api_key_stored = true
+
+  [[providers.models]]
+  name = "gpt-stored"
+
+[[tools.commands]]
+name = "slow"
+command = ["make"]
+timeout = "2m"
+`
+	if err := os.WriteFile(filepath.Join(dir, "henk", "config.toml"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+
+	// the key of a provider is only needed when it is used
+	config, err := ReadConfig()
+	if err != nil {
+		t.Fatalf("expected config without the key to be read, got %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if _, err := llm.NewLLM(config.Providers[0], "gpt", ""); err == nil || !strings.Contains(err.Error(), "HENK_TEST_MISSING_KEY") {
+		t.Errorf("expected the missing variable when the provider is used, got %v", err)
+	}
+	if config.Providers[1].KeyStore == nil {
+		t.Error("expected the key store to be set")
+	}
+	if act := config.Tools.TimeoutFor("slow"); act != 2*time.Minute {
+		t.Errorf("expected the timeout of the command, got %s", act)
+	}
+
+	config.Providers[0].ApiKeyCommand = "echo key"
+	if err := config.Validate(); err == nil {
+		t.Error("expected an error for two sources of the key")
+	}
+}
+
+func TestReadConfigLimits(t *testing.T) {
+	providers := `
+[[providers]]
+type = "ollama"
+name = "ollama"
+
+  [[providers.models]]
+  name = "qwen3"
+`
+	for _, tc := range []struct {
+		name  string
+		tools string
+		exp   ToolsConfig
+	}{
+		{
+			name: "defaults",
+			exp: ToolsConfig{
+				Timeout:    30 * time.Second,
+				MaxRounds:  25,
+				MaxOutput:  1024 * 1024,
+				MaxTime:    10 * time.Minute,
+				MaxRepeats: 3,
+			},
+		},
+		{
+			name:  "off",
+			tools: "[tools]\ntimeout = \"0s\"\nmax_rounds = 0\nmax_output = 0\nmax_time = \"0s\"\nmax_repeats = 0\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", dir)
+			if err := os.MkdirAll(filepath.Join(dir, "henk"), 0o755); err != nil {
+				t.Fatalf("could not create config dir: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "henk", "config.toml"), []byte(tc.tools+providers), 0o644); err != nil {
+				t.Fatalf("could not write config: %v", err)
+			}
+			config, err := ReadConfig()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if act := config.Tools.TimeoutFor("read_file"); act != tc.exp.Timeout {
+				t.Errorf("expected timeout %s, got %s", tc.exp.Timeout, act)
+			}
+			act := config.Tools
+			if act.MaxRounds != tc.exp.MaxRounds || act.MaxOutput != tc.exp.MaxOutput || act.MaxTime != tc.exp.MaxTime || act.MaxRepeats != tc.exp.MaxRepeats {
+				t.Errorf("expected limits %+v, got %+v", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestLoadSession(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if a, b := NewSession(), NewSession(); a.ID == b.ID {
+		t.Errorf("expected sessions started at the same time to differ, both are %s", a.ID)
+	}
+
+	s := NewSession()
+	s.Conversation.Append(userMessage("one"))
+	s.Conversation.Append(userMessage("two"))
+	if err := s.Save(); err != nil {
+		t.Fatalf("could not save session: %v", err)
+	}
+	loaded, err := LoadSession(s.ID)
+	if err != nil {
+		t.Fatalf("could not load session: %v", err)
+	}
+	if len(loaded.Conversation.Messages()) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(loaded.Conversation.Messages()))
+	}
+
+	for _, id := range []string{"../config", "a/b", ".hidden", ""} {
+		if _, err := LoadSession(id); err == nil || !strings.Contains(err.Error(), "invalid session id") {
+			t.Errorf("expected %q to be refused, got %v", id, err)
+		}
+	}
+
+	for name, damage := range map[string]func(c *Conversation){
+		"head":   func(c *Conversation) { c.Head = 5 },
+		"parent": func(c *Conversation) { c.Turns[1].Parent = 7 },
+		"loop":   func(c *Conversation) { c.Turns[0].Parent = 1 },
+	} {
+		damaged := NewSession()
+		damaged.Conversation.Append(userMessage("one"))
+		damaged.Conversation.Append(userMessage("two"))
+		damage(damaged.Conversation)
+		if err := damaged.Save(); err != nil {
+			t.Fatalf("could not save session: %v", err)
+		}
+		if _, err := LoadSession(damaged.ID); err == nil || !strings.Contains(err.Error(), "damaged") {
+			t.Errorf("%s: expected a damaged session, got %v", name, err)
+		}
+	}
+}
+
+func TestExportArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args      string
+		expFormat string
+		expPath   string
+	}{
+		{args: "", expFormat: FormatMarkdown},
+		{args: "html", expFormat: FormatHTML},
+		{args: "json out.txt", expFormat: FormatJSON, expPath: "out.txt"},
+		{args: "chat.html", expFormat: FormatHTML, expPath: "chat.html"},
+		{args: "chat.JSON", expFormat: FormatJSON, expPath: "chat.JSON"},
+		{args: "chat.txt", expFormat: FormatMarkdown, expPath: "chat.txt"},
+		{args: "md chat.html", expFormat: FormatMarkdown, expPath: "chat.html"},
+	} {
+		format, path := ParseExportArgs(strings.Fields(tc.args))
+		if format != tc.expFormat || path != tc.expPath {
+			t.Errorf("%q: expected %s %q, got %s %q", tc.args, tc.expFormat, tc.expPath, format, path)
+		}
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	text := strings.Repeat("é", 10)
+	if act := truncate(text, 5); !utf8.ValidString(act) || !strings.HasPrefix(act, "éé\n") || !strings.HasSuffix(act, "(16 more bytes)") {
+		t.Errorf("expected a cut between runes, got %q", act)
+	}
+	line := strings.Repeat("日本語", 10)
+	if act := firstLine(line, 0); !utf8.ValidString(act) || act != strings.Repeat("日本語", 6)+"日本..." {
+		t.Errorf("expected 20 runes, got %q", act)
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	h := loadHistory()
+	for i := range historyLimit + 5 {
+		h.Add(fmt.Sprintf("message %d", i))
+	}
+
+	h = loadHistory()
+	if h.Len() != historyLimit || h.Get(0) != "message 5" {
+		t.Fatalf("expected the last %d messages, got %d starting with %q", historyLimit, h.Len(), h.Get(0))
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		t.Fatalf("could not read history: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != historyLimit {
+		t.Errorf("expected %d lines in the file, got %d", historyLimit, lines)
+	}
+}
+
+func TestTerminalRenderCache(t *testing.T) {
+	m := newModel(make(chan string), make(chan editorFinishedMsg))
+	m.resize(80, 24)
+	m.receive(Message{Type: TypeHenk, Body: "hello"})
+	m.receive(Message{Type: TypeTool, ID: "1", Body: "read_file"})
+	first := m.entries[0].rendered
+	if first == "" || m.entries[1].rendered == "" {
+		t.Fatal("expected the entries to be rendered")
+	}
+
+	m.entries[0].rendered = "cached"
+	m.receive(Message{Type: TypeToolResult, ID: "1", Body: "ok"})
+	if m.entries[0].rendered != "cached" {
+		t.Error("expected an unchanged entry to keep its output")
+	}
+	if !strings.Contains(m.entries[1].rendered, "done") {
+		t.Errorf("expected the tool to be rendered again, got %q", m.entries[1].rendered)
+	}
+
+	m.resize(60, 24)
+	if m.entries[0].rendered == "cached" {
+		t.Error("expected a resize to render everything again")
+	}
+}
+
+func TestCodeFence(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		exp  string
+	}{
+		{text: "plain", exp: "```"},
+		{text: "a `b` c", exp: "```"},
+		{text: "# Readme\n```go\nfmt.Println()\n```\n", exp: "````"},
+		{text: "````` and ``", exp: "``````"},
+	} {
+		if act := codeFence(tc.text); act != tc.exp {
+			t.Errorf("%q: expected %q, got %q", tc.text, tc.exp, act)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go-mod.ewintr.nl/henk/agent/llm"
+)
+
+// budget keeps track of the tool calls that the LLM makes in answer to one
+// message of the user, so that a model that goes round in circles can be
+// stopped.
+type budget struct {
+	config ToolsConfig
+	start  time.Time
+	rounds int
+	output int
+	calls  map[string]int
+}
+
+func newBudget(config ToolsConfig) *budget {
+	return &budget{
+		config: config,
+		start:  time.Now(),
+		calls:  make(map[string]int),
+	}
+}
+
+// add counts a round of tool calls and their results. It returns the reason
+// to stop if a limit was reached.
+func (b *budget) add(toolUses []llm.ToolUse, results []llm.ToolResult) string {
+	b.rounds++
+	for _, r := range results {
+		b.output += len(r.Result)
+	}
+	var repeated string
+	for _, tu := range toolUses {
+		call := formatToolCall(tu.Name, canonical(tu.Input))
+		b.calls[call]++
+		if b.config.MaxRepeats > 0 && b.calls[call] >= b.config.MaxRepeats && repeated == "" {
+			repeated = call
+		}
+	}
+
+	switch {
+	case b.config.MaxRounds > 0 && b.rounds >= b.config.MaxRounds:
+		return fmt.Sprintf("the model used tools %d rounds in a row", b.rounds)
+	case b.config.MaxOutput > 0 && b.output >= b.config.MaxOutput:
+		return fmt.Sprintf("the tools returned %d bytes of output", b.output)
+	case b.config.MaxTime > 0 && time.Since(b.start) >= b.config.MaxTime:
+		return fmt.Sprintf("the tool calls took longer than %v", b.config.MaxTime)
+	case repeated != "":
+		return fmt.Sprintf("the model called %s %d times", repeated, b.calls[repeated])
+	}
+
+	return ""
+}
+
+// canonical formats the input in a consistent way, so that calls with the
+// same arguments in a different order or layout are seen as equal.
+func canonical(input json.RawMessage) json.RawMessage {
+	var v any
+	if err := json.Unmarshal(input, &v); err != nil {
+		return input
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return input
+	}
+
+	return data
+}
@@ -2,17 +2,25 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"maps"
 	"os/exec"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"go-mod.ewintr.nl/henk/agent/llm"
 )
 
+// remoteTimeout limits the time to ask the providers for their models.
+const remoteTimeout = time.Minute
+
 var (
 	listModelsTpl *template.Template
 	helpTpl       *template.Template
+	branchesTpl   *template.Template
 )
 
 func init() {
@@ -29,30 +37,67 @@ func init() {
 - **{{ $key }}**: {{ $value }}
 {{ end }}
 
-Also, press ctrl-e to open an editor to edit your message.
+Keys:
+
+- **enter**: send message, **alt-enter** or **ctrl-j** for a new line
+- **up/down**: browse earlier messages
+- **ctrl-e**: open an editor to edit your message
+- **ctrl-t**: show or hide the details of tool calls and the thinking of the model
+- **tab/esc**: switch between typing and scrolling, **pgup/pgdown** scroll anytime
+`))
+
+	branchesTpl = template.Must(template.New("branches").Parse(`Messages in this session (\* marks the active branch):
+
+{{ range . }}{{ .Indent }}- **{{ .ID }}**{{ if .Active }} \*{{ end }}: {{ .Line }}
+{{ end }}
 `))
 }
 
-func (a *Agent) runCommand(input string) {
+// runCommand executes a slash command. It returns true if the conversation
+// should be sent to the LLM afterwards.
+func (a *Agent) runCommand(input string) bool {
 	cmd, args, _ := strings.Cut(input, " ")
 	cmd = strings.TrimPrefix(cmd, "/")
 	switch cmd {
 	case "quit":
-		a.done = true
-		a.out <- Message{Type: TypeExit}
+		a.quit()
 	case "status":
 		a.showStatus()
 	case "help":
 		a.showHelp()
 	case "models":
-		a.listModels()
+		a.listModels(args)
 	case "switch":
 		a.switchModel(args)
+	case "set":
+		a.setParam(args)
+	case "image":
+		return a.attachImage(args)
 	case "clear":
 		a.clearContext()
 	case "copy":
 		a.copyLastMessage()
+	case "retry":
+		return a.retry(args)
+	case "undo":
+		a.undo()
+	case "edit":
+		return a.edit()
+	case "branch":
+		a.branch(args)
+	case "branches":
+		a.listBranches()
+	case "checkout":
+		a.checkout(args)
+	case "sessions":
+		a.listSessions()
+	case "resume":
+		a.resume(args)
+	case "export":
+		a.export(args)
 	}
+
+	return false
 }
 
 func (a *Agent) showStatus() {
@@ -61,29 +106,67 @@ func (a *Agent) showStatus() {
 	if short != "" {
 		status = fmt.Sprintf("%s (%s)", status, short)
 	}
-	a.out <- Message{Type: TypeGeneral, Body: status}
+	// after a fallback or a switch, the last answer can be from another model
+	path := a.conversation.Path()
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].Model != "" {
+			status = fmt.Sprintf("%s\n\nLast answer by: %s", status, path[i].Model)
+			break
+		}
+	}
+	status = fmt.Sprintf("%s\n\nSession: %s", status, a.session.ID)
+	if u := a.usage; u.Total() > 0 {
+		status = fmt.Sprintf("%s\n\nLast answer: %d input tokens, %d output tokens", status, u.InputTokens, u.OutputTokens)
+		if u.CacheReadTokens > 0 || u.CacheWriteTokens > 0 {
+			status = fmt.Sprintf("%s, %d read from cache, %d written to cache", status, u.CacheReadTokens, u.CacheWriteTokens)
+		}
+	}
+	a.displayGen(status)
 }
 
 func (a *Agent) showHelp() {
 	cmds := map[string]string{
-		"/help":                      "Show this help message",
-		"/status":                    "Show current LLM",
-		"/models":                    "List available models",
-		"/switch [model]":            "Switch to model with complete name  or short name",
-		"/switch [provider] [model]": "Switch to specific provider model",
-		"/clear":                     "Reset conversation, clear the context",
-		"/copy":                      "Copy last message to the clipboard",
-		"/quit":                      "Exit the agent",
+		"/help":                         "Show this help message",
+		"/status":                       "Show current LLM",
+		"/models [--remote]":            "List available models, or ask the providers which models they offer",
+		"/switch [model]":               "Switch to model with complete name  or short name",
+		"/switch [provider] [model]":    "Switch to specific provider model",
+		"/set [name] [value]":           "Set a generation parameter, like temperature, until henk exits. Without value it goes back to the config, without name all are shown",
+		"/image [path] [question]":      "Show an image to the model, with the question or with the next message",
+		"/clear":                        "Reset conversation, clear the context",
+		"/retry [model]":                "Ask again for an answer to the last message, optionally with another model",
+		"/undo":                         "Remove the last message and everything after it",
+		"/edit":                         "Edit the last message in your editor and ask again",
+		"/branch [id]":                  "Start a new branch with an alternative for message id, or for the last message",
+		"/branches":                     "List the messages and branches of the conversation",
+		"/checkout [id]":                "Switch to the branch that contains message id",
+		"/sessions":                     "List stored sessions",
+		"/resume [session]":             "Continue a stored session",
+		"/export [md|html|json] [path]": "Export the conversation to a file, in the format of its extension if none is given",
+		"/copy":                         "Copy last message to the clipboard",
+		"/quit":                         "Exit the agent",
 	}
 	msg := bytes.NewBuffer([]byte{})
 	if err := helpTpl.Execute(msg, cmds); err != nil {
-		a.out <- Message{Type: TypeError, Body: fmt.Sprintf("could not execute help template: %v", err.Error())}
+		a.displayError(fmt.Sprintf("could not execute help template: %v", err.Error()))
 		return
 	}
-	a.out <- Message{Type: TypeGeneral, Body: msg.String()}
+	a.displayGen(msg.String())
 }
 
-func (a *Agent) listModels() {
+func (a *Agent) listModels(args string) {
+	switch strings.TrimSpace(args) {
+	case "":
+	case "--remote":
+		ctx, cancel := context.WithTimeout(a.ctx, remoteTimeout)
+		defer cancel()
+		a.displayGen(RemoteModels(ctx, a.config))
+		return
+	default:
+		a.displayError("Usage: /models [--remote]")
+		return
+	}
+
 	type item struct {
 		Provider string
 		Model    string
@@ -101,17 +184,18 @@ func (a *Agent) listModels() {
 	}
 	msg := bytes.NewBuffer([]byte{})
 	if err := listModelsTpl.Execute(msg, data); err != nil {
-		a.out <- Message{Type: TypeError, Body: fmt.Sprintf("could not execute listModels template: %v", err.Error())}
+		a.displayError(fmt.Sprintf("could not execute listModels template: %v", err.Error()))
+		return
 	}
 
-	a.out <- Message{Type: TypeGeneral, Body: msg.String()}
+	a.displayGen(msg.String())
 }
 
-func (a *Agent) switchModel(args string) {
+func (a *Agent) switchModel(args string) bool {
 	args = strings.TrimSpace(args)
 	if args == "" {
 		a.displayError("Usage: /switch <model> or /switch <provider> <model>")
-		return
+		return false
 	}
 
 	var provider llm.Provider
@@ -122,7 +206,7 @@ func (a *Agent) switchModel(args string) {
 		provider, ok = a.config.Provider(parts[0])
 		if !ok {
 			a.displayError(fmt.Sprintf("could not find provider %q", parts[0]))
-			return
+			return false
 		}
 		modelName = parts[1]
 	} else {
@@ -130,24 +214,309 @@ func (a *Agent) switchModel(args string) {
 		provider, ok = a.config.ProviderByModelName(modelName)
 		if !ok {
 			a.displayError(fmt.Sprintf("Could not find provider for model %q", modelName))
-			return
+			return false
 		}
 	}
 
-	newClient, err := llm.NewLLM(provider, modelName, a.config.SystemPrompt)
+	newClient, err := a.newClient(provider, modelName)
 	if err != nil {
 		a.displayError(fmt.Sprintf("Failed to switch: %q", err.Error()))
+		return false
 	}
 	a.llmClient = newClient
 
 	a.showStatus()
+	a.updateStatus()
+	return true
+}
+
+// newClient creates a client for the model with the parameters that were
+// changed with /set.
+func (a *Agent) newClient(provider llm.Provider, modelName string) (llm.LLM, error) {
+	client, err := llm.NewLLM(provider.WithParams(modelName, a.params), modelName, a.config.SystemPrompt)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.withRetry(client, provider), nil
+}
+
+// withRetry makes the client try failed requests again, as configured for
+// the provider, and tells the user when it does.
+func (a *Agent) withRetry(client llm.LLM, provider llm.Provider) llm.LLM {
+	return llm.NewRetry(client, provider.Retry, a.displayGen)
+}
+
+func (a *Agent) setParam(args string) {
+	provName, modelName, _ := a.llmClient.ModelInfo()
+	provider, ok := a.config.Provider(provName)
+	if !ok {
+		a.displayError(fmt.Sprintf("could not find provider %q", provName))
+		return
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		var params llm.Params
+		if m, ok := provider.Model(modelName); ok {
+			params = m.Params
+		}
+		params = params.Merge(a.params)
+		if params.String() == "" {
+			a.displayGen(fmt.Sprintf("No generation parameters set for %s, the defaults of the provider are used", modelName))
+			return
+		}
+		a.displayGen(fmt.Sprintf("Generation parameters for %s:\n\n%s", modelName, params))
+		return
+	}
+
+	params := a.params
+	params.Extra = maps.Clone(a.params.Extra)
+	name, values := fields[0], fields[1:]
+	if len(values) == 0 {
+		params.Unset(name)
+	} else if err := params.Set(name, values...); err != nil {
+		a.displayError(fmt.Sprintf("could not set parameter: %v", err))
+		return
+	}
+
+	a.params = params
+	newClient, err := a.newClient(provider, modelName)
+	if err != nil {
+		a.displayError(fmt.Sprintf("could not apply parameters: %v", err))
+		return
+	}
+	a.llmClient = newClient
+
+	if len(values) == 0 {
+		a.displayGen(fmt.Sprintf("Reset %s to the value in the config", name))
+		return
+	}
+	a.displayGen(fmt.Sprintf("Set %s", strings.Join(fields, " ")))
+}
+
+// attachImage adds an image to the conversation. With a question, it is sent
+// right away. Without, it waits for the next message.
+func (a *Agent) attachImage(args string) bool {
+	path, question, _ := strings.Cut(strings.TrimSpace(args), " ")
+	if path == "" {
+		a.displayError("Usage: /image <path> [question]")
+		return false
+	}
+	prov, mod, _ := a.llmClient.ModelInfo()
+	if err := a.checkVision(prov, mod); err != nil {
+		a.displayError(err.Error())
+		return false
+	}
+	img, err := readImage(path)
+	if err != nil {
+		a.displayError(err.Error())
+		return false
+	}
+	block := llm.ContentBlock{Type: llm.ContentTypeImage, Image: img}
+
+	question = strings.TrimSpace(question)
+	if question == "" {
+		a.pendingImages = append(a.pendingImages, block)
+		a.displayGen(fmt.Sprintf("Attached %s, it will be sent with your next message", path))
+		return false
+	}
+	msg := userMessage(question)
+	msg.Content = append(msg.Content, a.takeImages()...)
+	msg.Content = append(msg.Content, block)
+	a.appendMessage(msg)
+
+	return true
 }
 
 func (a *Agent) clearContext() {
-	a.conversation = make([]llm.Message, 0)
+	a.pendingImages = nil
+	a.setSession(NewSession())
+	a.updateStatus()
 	a.displayGen("Context cleared")
 }
 
+// The commands below never delete messages. Moving the head of the
+// conversation keeps the old answers around as a branch that can be checked
+// out later.
+
+func (a *Agent) retry(args string) bool {
+	last := a.conversation.LastUserTurn()
+	if last == noTurn {
+		a.displayError("No message found to retry")
+		return false
+	}
+	if strings.TrimSpace(args) != "" && !a.switchModel(args) {
+		return false
+	}
+
+	a.conversation.SetHead(last)
+	a.saveSession()
+	return true
+}
+
+func (a *Agent) undo() {
+	last := a.conversation.LastUserTurn()
+	if last == noTurn {
+		a.displayError("No message found to undo")
+		return
+	}
+
+	// everything after the user message is a response to it, so leaving it
+	// all out keeps tool uses and tool results paired
+	a.conversation.SetHead(a.conversation.Turns[last].Parent)
+	a.saveSession()
+	a.displayGen("Removed last message")
+}
+
+func (a *Agent) edit() bool {
+	last := a.conversation.LastUserTurn()
+	if last == noTurn {
+		a.displayError("No message found to edit")
+		return false
+	}
+
+	old := a.conversation.Turns[last].Message
+	text, err := a.ui.Edit(messageText(old))
+	if err != nil {
+		a.displayError(fmt.Sprintf("Could not edit the message: %v", err))
+		return false
+	}
+	if strings.TrimSpace(text) == "" {
+		a.displayError("Empty message, nothing changed")
+		return false
+	}
+
+	// the images that came with the message stay
+	msg := userMessage(text)
+	for _, content := range old.Content {
+		if content.Type == llm.ContentTypeImage {
+			msg.Content = append(msg.Content, content)
+		}
+	}
+	a.conversation.SetHead(a.conversation.Turns[last].Parent)
+	a.appendMessage(msg)
+	return true
+}
+
+func (a *Agent) branch(args string) {
+	id := a.conversation.LastUserTurn()
+	if args = strings.TrimSpace(args); args != "" {
+		var err error
+		if id, err = strconv.Atoi(args); err != nil {
+			a.displayError(fmt.Sprintf("Invalid message id %q", args))
+			return
+		}
+	}
+	t, ok := a.conversation.Turn(id)
+	if !ok || !isUserText(t.Message) {
+		a.displayError("Can only branch from a message you wrote, see /branches")
+		return
+	}
+
+	a.conversation.SetHead(t.Parent)
+	a.saveSession()
+	a.displayGen(fmt.Sprintf("Your next message starts a new branch as an alternative for message %d", id))
+}
+
+func (a *Agent) listBranches() {
+	type item struct {
+		Indent string
+		ID     int
+		Active bool
+		Line   string
+	}
+	data := make([]item, 0)
+	var walk func(id, depth int)
+	walk = func(id, depth int) {
+		if t, ok := a.conversation.Turn(id); ok && isUserText(t.Message) {
+			line, _, _ := strings.Cut(strings.TrimSpace(messageText(t.Message)), "\n")
+			data = append(data, item{
+				Indent: strings.Repeat("  ", depth),
+				ID:     id,
+				Active: a.conversation.OnPath(id),
+				Line:   line,
+			})
+		}
+		children := a.conversation.Children(id)
+		if len(children) > 1 {
+			depth++
+		}
+		for _, c := range children {
+			walk(c, depth)
+		}
+	}
+	walk(noTurn, 0)
+	if len(data) == 0 {
+		a.displayGen("No messages yet")
+		return
+	}
+
+	msg := bytes.NewBuffer([]byte{})
+	if err := branchesTpl.Execute(msg, data); err != nil {
+		a.displayError(fmt.Sprintf("could not execute branches template: %v", err.Error()))
+		return
+	}
+	a.displayGen(msg.String())
+}
+
+func (a *Agent) checkout(args string) {
+	id, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil {
+		a.displayError("Usage: /checkout <id>")
+		return
+	}
+	if !a.conversation.Checkout(id) {
+		a.displayError(fmt.Sprintf("Could not find message %d", id))
+		return
+	}
+
+	a.saveSession()
+	a.displayGen(fmt.Sprintf("Switched to the branch with message %d", id))
+}
+
+func (a *Agent) listSessions() {
+	ids, err := ListSessions()
+	if err != nil {
+		a.displayError(err.Error())
+		return
+	}
+	if len(ids) == 0 {
+		a.displayGen("No stored sessions")
+		return
+	}
+
+	a.displayGen(fmt.Sprintf("Stored sessions:\n\n- %s", strings.Join(ids, "\n- ")))
+}
+
+func (a *Agent) resume(args string) {
+	id := strings.TrimSpace(args)
+	if id == "" {
+		a.displayError("Usage: /resume <session>")
+		return
+	}
+	s, err := LoadSession(id)
+	if err != nil {
+		a.displayError(err.Error())
+		return
+	}
+
+	a.setSession(s)
+	a.updateStatus()
+	a.displayGen(fmt.Sprintf("Resumed session %s with %d messages", s.ID, len(s.Conversation.Messages())))
+}
+
+func (a *Agent) export(args string) {
+	format, path := ParseExportArgs(strings.Fields(args))
+	path, err := a.session.ExportFile(format, path)
+	if err != nil {
+		a.displayError(fmt.Sprintf("Failed to export: %v", err))
+		return
+	}
+
+	a.displayGen(fmt.Sprintf("Conversation exported to %s", path))
+}
+
 func (a *Agent) copyLastMessage() {
 	if a.config.ClipboardCommand == "" {
 		a.displayError("No clipboard command configured in config file")
@@ -156,16 +525,10 @@ func (a *Agent) copyLastMessage() {
 
 	// Find the last assistant message with text content
 	var lastText string
-	for i := len(a.conversation) - 1; i >= 0; i-- {
-		msg := a.conversation[i]
-		if msg.Role == llm.RoleAssistant {
-			for _, content := range msg.Content {
-				if content.Type == llm.ContentTypeText && content.Text != "" {
-					lastText = content.Text
-					break
-				}
-			}
-			if lastText != "" {
+	msgs := a.conversation.Messages()
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == llm.RoleAssistant {
+			if lastText = messageText(msgs[i]); lastText != "" {
 				break
 			}
 		}
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"go-mod.ewintr.nl/henk/agent/llm"
+	"go-mod.ewintr.nl/henk/agent/tool"
 )
 
 type Config struct {
@@ -15,6 +17,47 @@ type Config struct {
 	Providers        []llm.Provider `toml:"providers"`
 	SystemPrompt     string         `toml:"system_prompt"`
 	ClipboardCommand string         `toml:"clipboard_command"`
+	Tools            ToolsConfig    `toml:"tools"`
+	// Fallbacks are tried in order when the current model fails.
+	Fallbacks []Fallback `toml:"fallbacks"`
+}
+
+type Fallback struct {
+	Provider string `toml:"provider"`
+	Model    string `toml:"model"`
+}
+
+type ToolsConfig struct {
+	// MaxParallel is the number of tool calls that can run at the same time.
+	MaxParallel int `toml:"max_parallel"`
+	// Timeout is the time a tool call may take, unless it is overridden for
+	// the tool in Timeouts. Zero means no limit.
+	Timeout  time.Duration            `toml:"timeout"`
+	Timeouts map[string]time.Duration `toml:"timeouts"`
+	// MaxFailedRounds is the number of rounds in a row in which all tool
+	// calls fail, after which the turn goes back to the user.
+	MaxFailedRounds int `toml:"max_failed_rounds"`
+	// The limits below apply to all tool calls that are made in answer to
+	// one message of the user. When one is reached, the user is asked
+	// whether to continue. Zero means no limit.
+	MaxRounds  int           `toml:"max_rounds"`
+	MaxOutput  int           `toml:"max_output"`
+	MaxTime    time.Duration `toml:"max_time"`
+	MaxRepeats int           `toml:"max_repeats"`
+	// Policy applies to tools that have no entry in Permissions. It defaults
+	// to allow.
+	Policy      string                `toml:"policy"`
+	Permissions map[string]Permission `toml:"permissions"`
+	// Commands are tools that are implemented by external programs.
+	Commands []tool.CommandConfig `toml:"commands"`
+}
+
+func (tc ToolsConfig) TimeoutFor(name string) time.Duration {
+	if t, ok := tc.Timeouts[name]; ok {
+		return t
+	}
+
+	return tc.Timeout
 }
 
 func (c Config) Validate() error {
@@ -43,6 +86,37 @@ func (c Config) Validate() error {
 		return fmt.Errorf("multiple models configured as default")
 	}
 
+	for _, p := range c.Providers {
+		sources := 0
+		for _, set := range []bool{p.ApiKeyEnv != "", p.ApiKeyCommand != "", p.ApiKeyStored} {
+			if set {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return fmt.Errorf("provider %s: use only one of api_key_env, api_key_command and api_key_stored", p.Name)
+		}
+	}
+
+	for _, f := range c.Fallbacks {
+		provider, ok := c.Provider(f.Provider)
+		if !ok {
+			return fmt.Errorf("fallback: could not find provider %q", f.Provider)
+		}
+		if _, ok := provider.Model(f.Model); !ok {
+			return fmt.Errorf("fallback: could not find model %q in provider %q", f.Model, f.Provider)
+		}
+	}
+
+	if err := (Permission{Policy: c.Tools.Policy}).Validate(); err != nil {
+		return fmt.Errorf("default tool policy: %v", err)
+	}
+	for name, p := range c.Tools.Permissions {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("permission for tool %s: %v", name, err)
+		}
+	}
+
 	return nil
 }
 
@@ -67,42 +141,84 @@ func (c Config) ProviderByModelName(name string) (llm.Provider, bool) {
 }
 
 func ReadConfig() (Config, error) {
-	userConfigDir, err := os.UserConfigDir()
+	configDir, err := configDir()
 	if err != nil {
-		return Config{}, fmt.Errorf("could not find user config dir: %v", err)
-	}
-	configDir := filepath.Join(userConfigDir, "henk")
-	if err := setupDir(configDir); err != nil {
-		return Config{}, fmt.Errorf("could not create config dir: %v", err)
+		return Config{}, err
 	}
 	configPath := filepath.Join(configDir, "config.toml")
 
 	var config Config
-	_, err = toml.DecodeFile(configPath, &config)
+	meta, err := toml.DecodeFile(configPath, &config)
 	if err != nil {
 		return Config{}, fmt.Errorf("could not read config file: %v", err)
 	}
 
-	// set keys
-	for i, p := range config.Providers {
-		if p.ApiKeyEnv != "" {
-			val, ok := os.LookupEnv(p.ApiKeyEnv)
-			if !ok {
-				return Config{}, fmt.Errorf("could not read environment variable %s", p.ApiKeyEnv)
+	// keys are resolved when the provider is used
+	store := newKeyStore(configDir)
+	for i := range config.Providers {
+		config.Providers[i].KeyStore = store
+	}
+
+	for i, c := range config.Tools.Commands {
+		// schema files are relative to the config
+		if c.SchemaFile != "" && !filepath.IsAbs(c.SchemaFile) {
+			config.Tools.Commands[i].SchemaFile = filepath.Join(configDir, c.SchemaFile)
+		}
+		// the timeout of the command goes before the general one
+		if c.Timeout > 0 {
+			if config.Tools.Timeouts == nil {
+				config.Tools.Timeouts = make(map[string]time.Duration)
 			}
-			p.ApiKey = val
+			config.Tools.Timeouts[c.Name] = c.Timeout
 		}
-		config.Providers[i] = p
 	}
 
 	// default values
 	if config.SystemPrompt == "" {
 		config.SystemPrompt = "You are a helpful assistent. Be concise and accurate in your responses."
 	}
+	if config.Tools.MaxParallel == 0 {
+		config.Tools.MaxParallel = 4
+	}
+	// a timeout of zero in the file turns it off
+	if !meta.IsDefined("tools", "timeout") {
+		config.Tools.Timeout = 30 * time.Second
+	}
+	if config.Tools.MaxFailedRounds == 0 {
+		config.Tools.MaxFailedRounds = 3
+	}
+	// like the timeout, a limit of zero turns it off
+	if !meta.IsDefined("tools", "max_rounds") {
+		config.Tools.MaxRounds = 25
+	}
+	if !meta.IsDefined("tools", "max_output") {
+		config.Tools.MaxOutput = 1024 * 1024
+	}
+	if !meta.IsDefined("tools", "max_time") {
+		config.Tools.MaxTime = 10 * time.Minute
+	}
+	if !meta.IsDefined("tools", "max_repeats") {
+		config.Tools.MaxRepeats = 3
+	}
 
 	return config, nil
 }
 
+// configDir returns the directory where henk stores its configuration and
+// state, creating it if necessary.
+func configDir() (string, error) {
+	userConfigDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("could not find user config dir: %v", err)
+	}
+	dir := filepath.Join(userConfigDir, "henk")
+	if err := setupDir(dir); err != nil {
+		return "", fmt.Errorf("could not create config dir: %v", err)
+	}
+
+	return dir, nil
+}
+
 func setupDir(path string) error {
 	info, err := os.Stat(path)
 	switch {
@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"go-mod.ewintr.nl/henk/agent/llm"
+)
+
+const noTurn = -1
+
+// Turn is a single message in the conversation tree.
+type Turn struct {
+	ID      int         `json:"id"`
+	Parent  int         `json:"parent"`
+	Created time.Time   `json:"created"`
+	Model   string      `json:"model,omitempty"`
+	Message llm.Message `json:"message"`
+}
+
+// Conversation stores all messages as a tree of turns, so that alternatives
+// can be explored without losing earlier ones. The path from the root to the
+// head is the active conversation that is sent to the LLM.
+type Conversation struct {
+	Turns []Turn `json:"turns"`
+	Head  int    `json:"head"`
+}
+
+func NewConversation() *Conversation {
+	return &Conversation{
+		Turns: make([]Turn, 0),
+		Head:  noTurn,
+	}
+}
+
+// Append adds a message after the head and makes it the new head.
+func (c *Conversation) Append(msg llm.Message) int {
+	id := len(c.Turns)
+	c.Turns = append(c.Turns, Turn{
+		ID:      id,
+		Parent:  c.Head,
+		Created: time.Now(),
+		Message: msg,
+	})
+	c.Head = id
+
+	return id
+}
+
+// Validate checks that the tree is intact, so that walking it can not go out
+// of range or loop. Append always adds a turn after its parent.
+func (c *Conversation) Validate() error {
+	for i, t := range c.Turns {
+		if t.ID != i {
+			return fmt.Errorf("turn %d has id %d", i, t.ID)
+		}
+		if t.Parent != noTurn && (t.Parent < 0 || t.Parent >= i) {
+			return fmt.Errorf("turn %d has invalid parent %d", i, t.Parent)
+		}
+	}
+	if c.Head != noTurn && (c.Head < 0 || c.Head >= len(c.Turns)) {
+		return fmt.Errorf("head %d is not a turn", c.Head)
+	}
+
+	return nil
+}
+
+func (c *Conversation) Turn(id int) (Turn, bool) {
+	if id < 0 || id >= len(c.Turns) {
+		return Turn{}, false
+	}
+
+	return c.Turns[id], true
+}
+
+// SetHead moves the head to the given turn. The turns after it are kept as
+// a separate branch.
+func (c *Conversation) SetHead(id int) {
+	c.Head = id
+}
+
+// Checkout makes the branch that contains the given turn active, by moving
+// the head to the most recent turn that descends from it.
+func (c *Conversation) Checkout(id int) bool {
+	if _, ok := c.Turn(id); !ok {
+		return false
+	}
+	for {
+		children := c.Children(id)
+		if len(children) == 0 {
+			break
+		}
+		id = children[len(children)-1]
+	}
+	c.Head = id
+
+	return true
+}
+
+// Children returns the ids of the turns that follow directly after the given
+// turn, in order of creation. Use noTurn to get the start of each branch.
+func (c *Conversation) Children(id int) []int {
+	children := make([]int, 0)
+	for _, t := range c.Turns {
+		if t.Parent == id {
+			children = append(children, t.ID)
+		}
+	}
+
+	return children
+}
+
+// Path returns the turns from the root to the head.
+func (c *Conversation) Path() []Turn {
+	path := make([]Turn, 0)
+	for id := c.Head; id != noTurn; id = c.Turns[id].Parent {
+		path = append(path, c.Turns[id])
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+
+	return path
+}
+
+// Messages returns the active conversation.
+func (c *Conversation) Messages() []llm.Message {
+	path := c.Path()
+	msgs := make([]llm.Message, 0, len(path))
+	for _, t := range path {
+		msgs = append(msgs, t.Message)
+	}
+
+	return msgs
+}
+
+// OnPath reports whether the turn is part of the active conversation.
+func (c *Conversation) OnPath(id int) bool {
+	for cur := c.Head; cur != noTurn; cur = c.Turns[cur].Parent {
+		if cur == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LastUserTurn returns the id of the last turn in the active conversation
+// that was typed by the user, as opposed to tool results that are also sent
+// with the user role. It returns noTurn if there is no such turn.
+func (c *Conversation) LastUserTurn() int {
+	for id := c.Head; id != noTurn; id = c.Turns[id].Parent {
+		if isUserText(c.Turns[id].Message) {
+			return id
+		}
+	}
+
+	return noTurn
+}
+
+func isUserText(msg llm.Message) bool {
+	if msg.Role != llm.RoleUser {
+		return false
+	}
+	for _, content := range msg.Content {
+		if content.Type == llm.ContentTypeText {
+			return true
+		}
+	}
+
+	return false
+}
+
+func messageText(msg llm.Message) string {
+	for _, content := range msg.Content {
+		if content.Type == llm.ContentTypeText && content.Text != "" {
+			return content.Text
+		}
+	}
+
+	return ""
+}
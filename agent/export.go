@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"go-mod.ewintr.nl/henk/agent/llm"
+)
+
+const (
+	FormatMarkdown = "md"
+	FormatHTML     = "html"
+	FormatJSON     = "json"
+
+	exportResultLimit = 2000
+)
+
+var htmlExportTpl *template.Template
+
+func init() {
+	htmlExportTpl = template.Must(template.New("htmlExport").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Henk session {{ .ID }}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+.meta { color: #888; font-size: small; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Henk session {{ .ID }}</h1>
+{{ range .Entries }}<div class="entry">
+{{ if .Tool }}<details><summary><strong>{{ .Who }}</strong>: <code>{{ .Tool }}</code></summary>
+<pre>{{ .Result }}</pre>
+</details>
+{{ else }}<strong>{{ .Who }}</strong>: {{ .Body }}
+{{ end }}<p class="meta">{{ .Meta }}</p>
+</div>
+{{ end }}</body>
+</html>
+`))
+}
+
+// exportEntry is a message as it is shown to the reader. Tool calls are
+// combined with their results.
+type exportEntry struct {
+	Who    string
+	Body   string
+	Tool   string
+	Result string
+	Meta   string
+}
+
+// Export renders the active branch of the conversation in the given format.
+func (s *Session) Export(format string) ([]byte, error) {
+	switch format {
+	case FormatMarkdown:
+		return []byte(s.exportMarkdown()), nil
+	case FormatHTML:
+		return s.exportHTML()
+	case FormatJSON:
+		return json.MarshalIndent(struct {
+			ID      string    `json:"id"`
+			Created time.Time `json:"created"`
+			Turns   []Turn    `json:"turns"`
+		}{
+			ID:      s.ID,
+			Created: s.Created,
+			Turns:   s.Conversation.Path(),
+		}, "", "  ")
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// ParseExportArgs takes the optional format and path from the arguments of an
+// export command. Without a format, it follows from the extension of the
+// path, and defaults to markdown.
+func ParseExportArgs(args []string) (string, string) {
+	var format string
+	if len(args) > 0 {
+		switch args[0] {
+		case FormatMarkdown, FormatHTML, FormatJSON:
+			format = args[0]
+			args = args[1:]
+		}
+	}
+	var path string
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".html", ".htm":
+			format = FormatHTML
+		case ".json":
+			format = FormatJSON
+		default:
+			format = FormatMarkdown
+		}
+	}
+
+	return format, path
+}
+
+// ExportFile writes the export to path. If path is empty, a file name based
+// on the session id is used. It returns the path that was written.
+func (s *Session) ExportFile(format, path string) (string, error) {
+	if path == "" {
+		path = fmt.Sprintf("henk-%s.%s", s.ID, format)
+	}
+	data, err := s.Export(format)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("could not write export: %v", err)
+	}
+
+	return path, nil
+}
+
+func (s *Session) exportMarkdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Henk session %s\n\n", s.ID)
+	for _, e := range s.exportEntries() {
+		if e.Tool != "" {
+			fence := codeFence(e.Result)
+			// markdown is not rendered inside html blocks
+			fmt.Fprintf(&b, "<details>\n<summary><b>%s</b>: <code>%s</code></summary>\n\n%s\n%s\n%s\n\n</details>\n\n", e.Who, html.EscapeString(e.Tool), fence, e.Result, fence)
+		} else {
+			fmt.Fprintf(&b, "%s\n\n", formatMessage(e.Who, e.Body))
+		}
+		fmt.Fprintf(&b, "_%s_\n\n", e.Meta)
+	}
+
+	return b.String()
+}
+
+func (s *Session) exportHTML() ([]byte, error) {
+	type htmlEntry struct {
+		exportEntry
+		Body template.HTML
+	}
+	entries := make([]htmlEntry, 0)
+	for _, e := range s.exportEntries() {
+		var body bytes.Buffer
+		if err := goldmark.Convert([]byte(e.Body), &body); err != nil {
+			return nil, fmt.Errorf("could not convert markdown: %v", err)
+		}
+		entries = append(entries, htmlEntry{
+			exportEntry: e,
+			// goldmark leaves out raw html by default, so this is safe
+			Body: template.HTML(body.String()),
+		})
+	}
+
+	var out bytes.Buffer
+	if err := htmlExportTpl.Execute(&out, struct {
+		ID      string
+		Entries []htmlEntry
+	}{
+		ID:      s.ID,
+		Entries: entries,
+	}); err != nil {
+		return nil, fmt.Errorf("could not execute html export template: %v", err)
+	}
+
+	return out.Bytes(), nil
+}
+
+func (s *Session) exportEntries() []exportEntry {
+	path := s.Conversation.Path()
+	results := make(map[string]llm.ToolResult)
+	for _, t := range path {
+		for _, content := range t.Message.Content {
+			if content.Type == llm.ContentTypeToolResult {
+				results[content.ToolResult.ID] = content.ToolResult
+			}
+		}
+	}
+
+	entries := make([]exportEntry, 0)
+	for _, t := range path {
+		meta := t.Created.Format(time.DateTime)
+		if t.Model != "" {
+			meta = fmt.Sprintf("%s, %s", meta, t.Model)
+		}
+		for _, content := range t.Message.Content {
+			switch content.Type {
+			case llm.ContentTypeText:
+				who := "You"
+				if t.Message.Role == llm.RoleAssistant {
+					who = "Henk"
+				}
+				entries = append(entries, exportEntry{Who: who, Body: content.Text, Meta: meta})
+			case llm.ContentTypeImage:
+				entries = append(entries, exportEntry{Who: "You", Body: fmt.Sprintf("*(%s image)*", content.Image.MediaType), Meta: meta})
+			case llm.ContentTypeToolUse:
+				tu := content.ToolUse
+				result := "no result"
+				if tr, ok := results[tu.ID]; ok {
+					result = truncate(tr.Result, exportResultLimit)
+					if tr.Error {
+						result = fmt.Sprintf("error: %s", result)
+					}
+				}
+				entries = append(entries, exportEntry{
+					Who:    "Tool",
+					Tool:   formatToolCall(tu.Name, tu.Input),
+					Result: result,
+					Meta:   meta,
+				})
+			}
+		}
+	}
+
+	return entries
+}
+
+// codeFence returns a fence for a code block around text. It is one backtick
+// longer than the longest run of backticks in the text, so that the text can
+// not end the block.
+func codeFence(text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r != '`' {
+			run = 0
+			continue
+		}
+		run++
+		longest = max(longest, run)
+	}
+
+	return strings.Repeat("`", max(longest+1, 3))
+}
+
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	// cut on the start of a rune, so that the text stays valid utf-8
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+
+	return fmt.Sprintf("%s\n... (%d more bytes)", s[:cut], len(s)-cut)
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+const historyLimit = 1000
+
+// history keeps the messages the user typed, so they can be recalled in
+// this and later runs. Each line in the file is a JSON encoded message, to
+// allow for messages that span multiple lines.
+type history struct {
+	path  string
+	items []string
+}
+
+// loadHistory reads the history file. Without it, history is kept in memory
+// only.
+func loadHistory() *history {
+	h := &history{items: make([]string, 0)}
+	dir, err := configDir()
+	if err != nil {
+		return h
+	}
+	h.path = filepath.Join(dir, "history")
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return h
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var item string
+		if err := json.Unmarshal(scanner.Bytes(), &item); err == nil {
+			h.items = append(h.items, item)
+		}
+	}
+	if len(h.items) > historyLimit {
+		h.items = h.items[len(h.items)-historyLimit:]
+	}
+
+	return h
+}
+
+func (h *history) Len() int         { return len(h.items) }
+func (h *history) Get(i int) string { return h.items[i] }
+
+// Add appends the item to the file. Once there are more than historyLimit
+// items, the file is written anew with only the most recent ones.
+func (h *history) Add(item string) {
+	if len(h.items) > 0 && h.items[len(h.items)-1] == item {
+		return
+	}
+	h.items = append(h.items, item)
+	if len(h.items) > historyLimit {
+		h.items = h.items[len(h.items)-historyLimit:]
+		h.write()
+		return
+	}
+	if h.path == "" {
+		return
+	}
+
+	line, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// write replaces the file with the items in memory. The new file is renamed
+// into place, so a failure halfway does not lose the history.
+func (h *history) write() {
+	if h.path == "" {
+		return
+	}
+
+	var b bytes.Buffer
+	for _, item := range h.items {
+		line, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		b.Write(append(line, '\n'))
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		os.Remove(tmp)
+	}
+}
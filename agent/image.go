@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"fmt"
+
+	"go-mod.ewintr.nl/henk/agent/llm"
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+// readImage loads an image from disk for /image.
+func readImage(path string) (llm.Image, error) {
+	img, err := tool.ReadImage(path)
+	if err != nil {
+		return llm.Image{}, fmt.Errorf("could not read image: %v", err)
+	}
+
+	return llm.Image{MediaType: img.MediaType, Data: img.Data}, nil
+}
+
+// checkVision returns an error if the model is configured as not being able
+// to look at images. Models without the setting are assumed to handle them.
+func (a *Agent) checkVision(providerName, modelName string) error {
+	provider, ok := a.config.Provider(providerName)
+	if !ok {
+		return nil
+	}
+	m, ok := provider.Model(modelName)
+	if !ok || m.Vision == nil || *m.Vision {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %s can not look at images, switch to a model with vision, or /clear the conversation", providerName, modelName)
+}
+
+func hasImages(conversation []llm.Message) bool {
+	for _, msg := range conversation {
+		for _, content := range msg.Content {
+			if content.Type == llm.ContentTypeImage || len(content.ToolResult.Images) > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
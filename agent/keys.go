@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"go-mod.ewintr.nl/henk/agent/llm"
+	"golang.org/x/term"
+)
+
+// PassphraseEnv can hold the passphrase of the key store, so that henk does
+// not have to ask for it.
+const PassphraseEnv = "HENK_PASSPHRASE"
+
+func newKeyStore(configDir string) *llm.KeyStore {
+	return llm.NewKeyStore(filepath.Join(configDir, "keys.enc"), passphrase)
+}
+
+// OpenKeyStore returns the encrypted key store in the config directory.
+func OpenKeyStore() (*llm.KeyStore, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return newKeyStore(dir), nil
+}
+
+// uiStarted is set when the agent starts. From then on, the UI owns the
+// terminal and the passphrase can not be asked for.
+var uiStarted atomic.Bool
+
+// passphrase reads the passphrase from the environment, or asks for it on
+// the terminal. The store is opened when the first provider that uses it is
+// selected, that is before the UI starts if it is the default provider.
+func passphrase() (string, error) {
+	if p, ok := os.LookupEnv(PassphraseEnv); ok {
+		return p, nil
+	}
+	if uiStarted.Load() {
+		return "", fmt.Errorf("can not ask for the passphrase of the key store while henk runs, set %s", PassphraseEnv)
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to ask for the passphrase, set %s", PassphraseEnv)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, "Passphrase for the key store: ")
+	p, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+	if len(p) == 0 {
+		return "", errors.New("no passphrase given")
+	}
+
+	return string(p), nil
+}
@@ -2,19 +2,25 @@ package llm
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
 	"go-mod.ewintr.nl/henk/agent/tool"
 )
 
+// claudeMaxTokens is used when the model has no max_tokens, the API requires
+// one.
+const claudeMaxTokens = 8192
+
 type Claude struct {
 	client         *anthropic.Client
 	provider       Provider
 	modelName      string
 	modelShortName string
 	systemPrompt   string
+	params         Params
+	cache          bool
 }
 
 func NewClaude(provider Provider, modelName, systemPrompt string) (*Claude, error) {
@@ -23,16 +29,33 @@ func NewClaude(provider Provider, modelName, systemPrompt string) (*Claude, erro
 		return nil, fmt.Errorf("%w: could not find model %q in provider %q", ErrUnknownModel, modelName, provider.Name)
 	}
 
-	c := anthropic.NewClient()
+	c := anthropic.NewClient(claudeOptions(provider)...)
 	return &Claude{
 		client:         &c,
 		provider:       provider,
 		modelName:      m.Name,
 		modelShortName: m.ShortName,
 		systemPrompt:   systemPrompt,
+		params:         m.Params,
+		cache:          m.PromptCache == nil || *m.PromptCache,
 	}, nil
 }
 
+// claudeOptions sets the key and the URL from the config. Without them, the
+// SDK falls back to ANTHROPIC_API_KEY and ANTHROPIC_BASE_URL.
+func claudeOptions(provider Provider) []option.RequestOption {
+	// failed requests are retried by Retry
+	opts := []option.RequestOption{option.WithMaxRetries(0)}
+	if provider.ApiKey != "" {
+		opts = append(opts, option.WithAPIKey(provider.ApiKey))
+	}
+	if provider.BaseURL != "" {
+		opts = append(opts, option.WithBaseURL(provider.BaseURL))
+	}
+
+	return opts
+}
+
 func (c *Claude) ModelInfo() (string, string, string) {
 	return c.provider.Name, c.modelName, c.modelShortName
 }
@@ -40,29 +63,64 @@ func (c *Claude) ModelInfo() (string, string, string) {
 func (c *Claude) RunInference(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
 	antConv := make([]anthropic.MessageParam, 0, len(conversation))
 	for _, msg := range conversation {
+		antBlocks := make([]anthropic.ContentBlockParamUnion, 0, len(msg.Content))
 		for _, block := range msg.Content {
-			var antBlock anthropic.ContentBlockParamUnion
 			switch block.Type {
 			case ContentTypeText:
-				antBlock = anthropic.NewTextBlock(block.Text)
+				antBlocks = append(antBlocks, anthropic.NewTextBlock(block.Text))
 			case ContentTypeToolUse:
 				tu := block.ToolUse
-				antBlock = anthropic.NewToolUseBlock(tu.ID, tu.Input, tu.Name)
+				antBlocks = append(antBlocks, anthropic.NewToolUseBlock(tu.ID, tu.Input, tu.Name))
 			case ContentTypeToolResult:
 				tr := block.ToolResult
-				antBlock = anthropic.NewToolResultBlock(tr.ID, tr.Result, tr.Error)
+				result := anthropic.NewToolResultBlock(tr.ID, tr.Result, tr.Error)
+				for _, img := range tr.Images {
+					result.OfToolResult.Content = append(result.OfToolResult.Content, anthropic.ToolResultBlockParamContentUnion{
+						OfImage: anthropic.NewImageBlockBase64(img.MediaType, img.Base64()).OfImage,
+					})
+				}
+				antBlocks = append(antBlocks, result)
+			case ContentTypeImage:
+				antBlocks = append(antBlocks, anthropic.NewImageBlockBase64(block.Image.MediaType, block.Image.Base64()))
+			case ContentTypeThinking:
+				// thinking of other models has no signature and is refused
+				th := block.Thinking
+				switch {
+				case th.Redacted != "":
+					antBlocks = append(antBlocks, anthropic.NewRedactedThinkingBlock(th.Redacted))
+				case th.Signature != "":
+					antBlocks = append(antBlocks, anthropic.NewThinkingBlock(th.Signature, th.Text))
+				}
 			default:
 				return Message{}, fmt.Errorf("Error: unknown message content type: %s\n", block.Type)
 			}
-			switch msg.Role {
-			case RoleAssistant:
-				antConv = append(antConv, anthropic.NewAssistantMessage(antBlock))
-			case RoleUser:
-				antConv = append(antConv, anthropic.NewUserMessage(antBlock))
-			default:
-				return Message{}, fmt.Errorf("Error: unknown message role: %s\n", msg.Role)
-			}
 		}
+
+		var antRole anthropic.MessageParamRole
+		switch msg.Role {
+		case RoleAssistant:
+			antRole = anthropic.MessageParamRoleAssistant
+		case RoleUser:
+			antRole = anthropic.MessageParamRoleUser
+		default:
+			return Message{}, fmt.Errorf("Error: unknown message role: %s\n", msg.Role)
+		}
+
+		// an answer of another model with only thinking has nothing left, and
+		// Claude refuses empty messages
+		if len(antBlocks) == 0 {
+			continue
+		}
+		// roles must alternate, so consecutive messages with the same role,
+		// like tool results that were stored separately, are combined
+		if last := len(antConv) - 1; last >= 0 && antConv[last].Role == antRole {
+			antConv[last].Content = append(antConv[last].Content, antBlocks...)
+			continue
+		}
+		antConv = append(antConv, anthropic.MessageParam{
+			Role:    antRole,
+			Content: antBlocks,
+		})
 	}
 
 	antTools := []anthropic.ToolUnionParam{}
@@ -73,20 +131,51 @@ func (c *Claude) RunInference(ctx context.Context, tools []tool.Tool, conversati
 				Description: anthropic.String(tool.Description()),
 				InputSchema: anthropic.ToolInputSchemaParam{
 					Properties: tool.InputSchema().Properties,
+					Required:   tool.InputSchema().Required,
 				},
 			},
 		})
 	}
 
 	antSystem := []anthropic.TextBlockParam{{Text: c.systemPrompt}}
+	if c.cache {
+		setCacheBreakpoints(antSystem, antTools, antConv)
+	}
 
-	antMessage, err := c.client.Messages.New(ctx, anthropic.MessageNewParams{
-		Model:     anthropic.Model(c.modelName),
-		MaxTokens: int64(2048),
-		Messages:  antConv,
-		Tools:     antTools,
-		System:    antSystem,
-	})
+	params := anthropic.MessageNewParams{
+		Model:         anthropic.Model(c.modelName),
+		MaxTokens:     int64(claudeMaxTokens),
+		Messages:      antConv,
+		Tools:         antTools,
+		System:        antSystem,
+		StopSequences: c.params.Stop,
+	}
+	if c.params.MaxTokens != nil {
+		params.MaxTokens = int64(*c.params.MaxTokens)
+	}
+	if c.params.Temperature != nil {
+		params.Temperature = anthropic.Float(*c.params.Temperature)
+	}
+	if c.params.TopP != nil {
+		params.TopP = anthropic.Float(*c.params.TopP)
+	}
+	if c.params.TopK != nil {
+		params.TopK = anthropic.Int(int64(*c.params.TopK))
+	}
+	if budget := c.params.ThinkingBudget; budget != nil && *budget > 0 {
+		params.Thinking = anthropic.ThinkingConfigParamOfEnabled(int64(*budget))
+		// the budget is part of max_tokens, there must be room left for the
+		// answer
+		if params.MaxTokens <= int64(*budget) {
+			params.MaxTokens = int64(*budget + claudeMaxTokens)
+		}
+	}
+	opts := make([]option.RequestOption, 0, len(c.params.Extra))
+	for k, v := range c.params.Extra {
+		opts = append(opts, option.WithJSONSet(k, v))
+	}
+
+	antMessage, err := c.client.Messages.New(ctx, params, opts...)
 	if err != nil {
 		return Message{}, err
 	}
@@ -94,37 +183,78 @@ func (c *Claude) RunInference(ctx context.Context, tools []tool.Tool, conversati
 	message := Message{
 		Role:    RoleAssistant,
 		Content: []ContentBlock{},
+		Usage: Usage{
+			InputTokens:      int(antMessage.Usage.InputTokens),
+			OutputTokens:     int(antMessage.Usage.OutputTokens),
+			CacheReadTokens:  int(antMessage.Usage.CacheReadInputTokens),
+			CacheWriteTokens: int(antMessage.Usage.CacheCreationInputTokens),
+		},
 	}
-	for _, block := range antMessage.ToParam().Content {
-		tp := block.GetType()
-		switch *tp {
+	for _, block := range antMessage.Content {
+		switch block.Type {
 		case "text":
-			text := block.GetText()
 			message.Content = append(message.Content, ContentBlock{
 				Type: ContentTypeText,
-				Text: *text,
+				Text: block.Text,
+			})
+		case "thinking":
+			message.Content = append(message.Content, ContentBlock{
+				Type: ContentTypeThinking,
+				Thinking: Thinking{
+					Text:      block.Thinking,
+					Signature: block.Signature,
+				},
+			})
+		case "redacted_thinking":
+			message.Content = append(message.Content, ContentBlock{
+				Type:     ContentTypeThinking,
+				Thinking: Thinking{Redacted: block.Data},
 			})
 		case "tool_use":
-			id := block.GetID()
-			name := block.GetName()
-			inputAnyPtr := block.GetInput()
-			inputAny := *inputAnyPtr
-			input, ok := inputAny.(json.RawMessage)
-			if !ok {
-				return Message{}, fmt.Errorf("could not cast tool input to json.RawMessage")
-			}
 			message.Content = append(message.Content, ContentBlock{
 				Type: ContentTypeToolUse,
 				ToolUse: ToolUse{
-					ID:    *id,
-					Name:  *name,
-					Input: input,
+					ID:    block.ID,
+					Name:  block.Name,
+					Input: block.Input,
 				},
 			})
 		default:
-			return Message{}, fmt.Errorf("unknown content type: %s\n", *tp)
+			return Message{}, fmt.Errorf("unknown content type: %s\n", block.Type)
 		}
 	}
 
 	return message, nil
 }
+
+// claudeCacheMessages is the number of user messages at the end of the
+// conversation that get a cache breakpoint. With the system prompt and the
+// tools, this uses the four breakpoints that the API allows.
+const claudeCacheMessages = 2
+
+// setCacheBreakpoints marks the end of the system prompt, the tools and the
+// last user messages for caching. Everything before a breakpoint is cached.
+// The breakpoint on the last message writes the conversation to the cache,
+// the one before it is where the previous round can be read back.
+func setCacheBreakpoints(system []anthropic.TextBlockParam, tools []anthropic.ToolUnionParam, conv []anthropic.MessageParam) {
+	if len(system) > 0 {
+		system[len(system)-1].CacheControl = anthropic.NewCacheControlEphemeralParam()
+	}
+	if len(tools) > 0 {
+		if t := tools[len(tools)-1].OfTool; t != nil {
+			t.CacheControl = anthropic.NewCacheControlEphemeralParam()
+		}
+	}
+
+	marked := 0
+	for i := len(conv) - 1; i >= 0 && marked < claudeCacheMessages; i-- {
+		msg := conv[i]
+		if msg.Role != anthropic.MessageParamRoleUser || len(msg.Content) == 0 {
+			continue
+		}
+		if cc := msg.Content[len(msg.Content)-1].GetCacheControl(); cc != nil {
+			*cc = anthropic.NewCacheControlEphemeralParam()
+			marked++
+		}
+	}
+}
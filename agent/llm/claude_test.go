@@ -0,0 +1,185 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+func TestClaudePromptCache(t *testing.T) {
+	conversation := []Message{
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "one"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "first answer"}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "two"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeToolUse, ToolUse: ToolUse{ID: "call_1", Name: "read_file", Input: json.RawMessage(`{}`)}}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeToolResult, ToolResult: ToolResult{ID: "call_1", Result: "text"}}}},
+	}
+	off := false
+	for _, tc := range []struct {
+		name     string
+		cache    *bool
+		expMarks []string
+	}{
+		{
+			name:     "default",
+			expMarks: []string{"system", "tool list_files", "message 2", "message 4"},
+		},
+		{
+			name:  "off",
+			cache: &off,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var body struct {
+				System   []map[string]any `json:"system"`
+				Tools    []map[string]any `json:"tools"`
+				Messages []struct {
+					Content []map[string]any `json:"content"`
+				} `json:"messages"`
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				if err := json.Unmarshal(data, &body); err != nil {
+					t.Errorf("could not parse request: %v", err)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				writeJSON(w, http.StatusOK, map[string]any{
+					"id":      "msg_1",
+					"type":    "message",
+					"role":    "assistant",
+					"model":   contractModel,
+					"content": []map[string]any{{"type": "text", "text": "ok"}},
+					"usage": map[string]any{
+						"input_tokens":                10,
+						"output_tokens":               5,
+						"cache_read_input_tokens":     1000,
+						"cache_creation_input_tokens": 200,
+					},
+				})
+			}))
+			defer srv.Close()
+
+			provider := testProvider("claude", srv.URL)
+			provider.Models[0].PromptCache = tc.cache
+			c, err := NewClaude(provider, contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create claude: %v", err)
+			}
+			msg, err := c.RunInference(context.Background(), []tool.Tool{tool.NewReadFile(), tool.NewListFiles()}, conversation)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			marks := make([]string, 0)
+			marked := func(block map[string]any) bool {
+				cc, ok := block["cache_control"].(map[string]any)
+				return ok && cc["type"] == "ephemeral"
+			}
+			for _, b := range body.System {
+				if marked(b) {
+					marks = append(marks, "system")
+				}
+			}
+			for _, tl := range body.Tools {
+				if marked(tl) {
+					marks = append(marks, "tool "+tl["name"].(string))
+				}
+			}
+			for i, m := range body.Messages {
+				for _, b := range m.Content {
+					if marked(b) {
+						marks = append(marks, fmt.Sprintf("message %d", i))
+					}
+				}
+			}
+			if len(marks) != len(tc.expMarks) {
+				t.Fatalf("expected breakpoints %v, got %v", tc.expMarks, marks)
+			}
+			for i := range marks {
+				if marks[i] != tc.expMarks[i] {
+					t.Errorf("expected breakpoints %v, got %v", tc.expMarks, marks)
+				}
+			}
+
+			exp := Usage{InputTokens: 10, OutputTokens: 5, CacheReadTokens: 1000, CacheWriteTokens: 200}
+			if msg.Usage != exp {
+				t.Errorf("expected usage %+v, got %+v", exp, msg.Usage)
+			}
+		})
+	}
+}
+
+// TestClaudeToolSchema checks that the required fields of a tool are sent, so
+// that the model does not leave them out.
+func TestClaudeToolSchema(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("could not parse request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		claudeStandIn().respond(w, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "ok"}}})
+	}))
+	defer srv.Close()
+
+	c, err := NewClaude(testProvider("claude", srv.URL), contractModel, contractSystemPrompt)
+	if err != nil {
+		t.Fatalf("could not create claude: %v", err)
+	}
+	if _, err := c.RunInference(context.Background(), []tool.Tool{tool.NewReadFile()}, []Message{{
+		Role:    RoleUser,
+		Content: []ContentBlock{{Type: ContentTypeText, Text: "read a.txt"}},
+	}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	schema := dig(body, "tools", 0, "input_schema")
+	if dig(schema, "properties", "path") == nil {
+		t.Errorf("expected the path property, got %v", schema)
+	}
+	if req, ok := dig(schema, "required").([]any); !ok || len(req) != 1 || req[0] != "path" {
+		t.Errorf("expected path to be required, got %v", schema)
+	}
+}
+
+// TestClaudeUnsignedThinking checks that an answer of another model with only
+// thinking is left out, instead of being sent as an empty message.
+func TestClaudeUnsignedThinking(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("could not parse request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		claudeStandIn().respond(w, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "ok"}}})
+	}))
+	defer srv.Close()
+
+	c, err := NewClaude(testProvider("claude", srv.URL), contractModel, contractSystemPrompt)
+	if err != nil {
+		t.Fatalf("could not create claude: %v", err)
+	}
+	if _, err := c.RunInference(context.Background(), nil, []Message{
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeThinking, Thinking: Thinking{Text: "hmm"}}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "hello?"}}},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msgs, _ := body["messages"].([]any)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one user message, got %v", msgs)
+	}
+	if act := dig(msgs, 0, "content", 1, "text"); act != "hello?" {
+		t.Errorf("expected both questions, got %v", msgs)
+	}
+}
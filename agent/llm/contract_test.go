@@ -0,0 +1,787 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+// The contract tests run the same scenarios against every provider. Each
+// provider gets a local stand-in for its API that translates the wire format
+// of the request to a common form, so that it can be compared, and that
+// answers with a canned response in the wire format of the provider.
+
+const (
+	contractSystemPrompt = "You are a test."
+	contractModel        = "test-model"
+	contractErrorMessage = "something is wrong with this request"
+)
+
+// part is a single piece of content of a request, in a form that is the same
+// for all providers. Turn is the index of the message on the wire that the
+// part is sent in. Tool results that need a message each share their turn.
+type part struct {
+	Turn     int
+	Role     Role
+	Type     ContentType
+	Text     string
+	ToolID   string
+	ToolName string
+	Input    string
+	Error    bool
+}
+
+type wireRequest struct {
+	System string
+	Parts  []part
+	Tools  []string
+}
+
+// standIn emulates the API of a provider.
+type standIn struct {
+	name string
+	// path is the endpoint the adapter is expected to call
+	path string
+	// newLLM creates the adapter for a server at baseURL
+	newLLM func(t *testing.T, baseURL string) LLM
+	// parse converts the body of a request to the common form
+	parse func(t *testing.T, body []byte) wireRequest
+	// respond writes the response in the wire format
+	respond func(w http.ResponseWriter, resp Message)
+	// respondError writes an error in the wire format
+	respondError func(w http.ResponseWriter)
+	// skip lists scenarios that the provider does not support yet
+	skip map[string]string
+	// errorFlag is true if the provider can mark a tool result as an error
+	errorFlag bool
+	// toolIDs is true if tool calls and results are linked by id, otherwise
+	// results carry the name of the tool
+	toolIDs bool
+}
+
+type scenario struct {
+	name         string
+	conversation []Message
+	response     Message
+	expParts     []part
+	fail         bool
+}
+
+func TestContract(t *testing.T) {
+	tools := []tool.Tool{tool.NewReadFile(), tool.NewListFiles()}
+	expTools := []string{"read_file", "list_files"}
+
+	for _, si := range []standIn{claudeStandIn(), openAIStandIn(), localStandIn(), ollamaStandIn(), geminiStandIn()} {
+		for _, sc := range contractScenarios(si) {
+			t.Run(fmt.Sprintf("%s/%s", si.name, sc.name), func(t *testing.T) {
+				if reason, ok := si.skip[sc.name]; ok {
+					t.Skip(reason)
+				}
+
+				received := make(chan wireRequest, 1)
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path != si.path {
+						t.Errorf("expected request to %s, got %s", si.path, r.URL.Path)
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					body, err := io.ReadAll(r.Body)
+					if err != nil {
+						t.Errorf("could not read request body: %v", err)
+						return
+					}
+					select {
+					case received <- si.parse(t, body):
+					default:
+						t.Errorf("expected one request, got more")
+					}
+					w.Header().Set("Content-Type", "application/json")
+					if sc.fail {
+						si.respondError(w)
+						return
+					}
+					si.respond(w, sc.response)
+				}))
+				defer srv.Close()
+
+				client := si.newLLM(t, srv.URL)
+				act, err := client.RunInference(context.Background(), tools, sc.conversation)
+				if sc.fail {
+					if err == nil {
+						t.Fatalf("expected error, got none")
+					}
+					if !strings.Contains(err.Error(), contractErrorMessage) {
+						t.Errorf("expected error to contain the message from the api, got %q", err.Error())
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				var req wireRequest
+				select {
+				case req = <-received:
+				default:
+					t.Fatalf("server did not receive a request")
+				}
+
+				if req.System != contractSystemPrompt {
+					t.Errorf("expected system prompt %q, got %q", contractSystemPrompt, req.System)
+				}
+				if !reflect.DeepEqual(req.Tools, expTools) {
+					t.Errorf("expected tools %v, got %v", expTools, req.Tools)
+				}
+				if !reflect.DeepEqual(req.Parts, sc.expParts) {
+					t.Errorf("request does not match\nexp: %+v\nact: %+v", sc.expParts, req.Parts)
+				}
+				compareResponse(t, sc.response, act)
+			})
+		}
+	}
+}
+
+func contractScenarios(si standIn) []scenario {
+	text := func(role Role, text string) Message {
+		return Message{Role: role, Content: []ContentBlock{{Type: ContentTypeText, Text: text}}}
+	}
+	toolUse := func(id, path string) ContentBlock {
+		return ContentBlock{Type: ContentTypeToolUse, ToolUse: ToolUse{
+			ID:    id,
+			Name:  "read_file",
+			Input: json.RawMessage(fmt.Sprintf(`{"path":%q}`, path)),
+		}}
+	}
+	toolResult := func(id, result string, isErr bool) ContentBlock {
+		return ContentBlock{
+			Type:       ContentTypeToolResult,
+			ToolResult: ToolResult{ID: id, Result: result, Error: isErr},
+		}
+	}
+	results := func(blocks ...ContentBlock) Message {
+		return Message{Role: RoleUser, Content: blocks}
+	}
+	inTurn := func(turn int, parts ...part) []part {
+		for i := range parts {
+			parts[i].Turn = turn
+		}
+		return parts
+	}
+	concat := func(parts ...[]part) []part {
+		all := make([]part, 0)
+		for _, p := range parts {
+			all = append(all, p...)
+		}
+		return all
+	}
+	textPart := func(role Role, text string) part {
+		return part{Role: role, Type: ContentTypeText, Text: text}
+	}
+	toolUsePart := func(id, path string) part {
+		p := part{Role: RoleAssistant, Type: ContentTypeToolUse, ToolName: "read_file", Input: fmt.Sprintf(`{"path":%q}`, path)}
+		if si.toolIDs {
+			p.ToolID = id
+		}
+		return p
+	}
+	toolResultPart := func(id, result string, isErr bool) part {
+		p := part{Role: RoleUser, Type: ContentTypeToolResult, Text: result, Error: isErr && si.errorFlag}
+		if isErr && !si.errorFlag {
+			p.Text = errorResultPrefix + result
+		}
+		if si.toolIDs {
+			p.ToolID = id
+		} else {
+			p.ToolName = "read_file"
+		}
+		return p
+	}
+	calls := Message{Role: RoleAssistant, Content: []ContentBlock{toolUse("call_a", "a.txt"), toolUse("call_b", "b.txt")}}
+
+	return []scenario{
+		{
+			name: "multi-turn",
+			conversation: []Message{
+				text(RoleUser, "hello"),
+				text(RoleAssistant, "hi there"),
+				text(RoleUser, "how are you?"),
+			},
+			response: text(RoleAssistant, "fine"),
+			expParts: concat(
+				inTurn(0, textPart(RoleUser, "hello")),
+				inTurn(1, textPart(RoleAssistant, "hi there")),
+				inTurn(2, textPart(RoleUser, "how are you?")),
+			),
+		},
+		{
+			name:         "parallel tool calls",
+			conversation: []Message{text(RoleUser, "read both files")},
+			response: Message{Role: RoleAssistant, Content: []ContentBlock{
+				{Type: ContentTypeText, Text: "I will read them"},
+				toolUse("call_a", "a.txt"),
+				toolUse("call_b", "b.txt"),
+			}},
+			expParts: inTurn(0, textPart(RoleUser, "read both files")),
+		},
+		{
+			name: "tool results",
+			conversation: []Message{
+				text(RoleUser, "read both files"),
+				calls,
+				results(
+					toolResult("call_a", "content of a", false),
+					toolResult("call_b", "content of b", false),
+				),
+			},
+			response: text(RoleAssistant, "done"),
+			expParts: concat(
+				inTurn(0, textPart(RoleUser, "read both files")),
+				inTurn(1, toolUsePart("call_a", "a.txt"), toolUsePart("call_b", "b.txt")),
+				inTurn(2, toolResultPart("call_a", "content of a", false), toolResultPart("call_b", "content of b", false)),
+			),
+		},
+		{
+			// older sessions have a message for each tool result
+			name: "separate tool results",
+			conversation: []Message{
+				text(RoleUser, "read both files"),
+				calls,
+				results(toolResult("call_a", "content of a", false)),
+				results(toolResult("call_b", "content of b", false)),
+			},
+			response: text(RoleAssistant, "done"),
+			expParts: concat(
+				inTurn(0, textPart(RoleUser, "read both files")),
+				inTurn(1, toolUsePart("call_a", "a.txt"), toolUsePart("call_b", "b.txt")),
+				inTurn(2, toolResultPart("call_a", "content of a", false), toolResultPart("call_b", "content of b", false)),
+			),
+		},
+		{
+			name: "tool error",
+			conversation: []Message{
+				text(RoleUser, "read both files"),
+				calls,
+				results(
+					toolResult("call_a", "content of a", false),
+					toolResult("call_b", "file not found", true),
+				),
+			},
+			response: text(RoleAssistant, "b is missing"),
+			expParts: concat(
+				inTurn(0, textPart(RoleUser, "read both files")),
+				inTurn(1, toolUsePart("call_a", "a.txt"), toolUsePart("call_b", "b.txt")),
+				inTurn(2, toolResultPart("call_a", "content of a", false), toolResultPart("call_b", "file not found", true)),
+			),
+		},
+		{
+			name:         "error response",
+			conversation: []Message{text(RoleUser, "hello")},
+			fail:         true,
+		},
+	}
+}
+
+// compareResponse checks the content of the response. Tool call ids are
+// generated by some providers, so only their presence and uniqueness is
+// checked.
+func compareResponse(t *testing.T, exp, act Message) {
+	t.Helper()
+
+	if act.Role != RoleAssistant {
+		t.Errorf("expected role assistant, got %q", act.Role)
+	}
+	if len(act.Content) != len(exp.Content) {
+		t.Fatalf("expected %d content blocks, got %d: %+v", len(exp.Content), len(act.Content), act.Content)
+	}
+	ids := make(map[string]bool)
+	for i, e := range exp.Content {
+		a := act.Content[i]
+		if a.Type != e.Type {
+			t.Errorf("block %d: expected type %q, got %q", i, e.Type, a.Type)
+			continue
+		}
+		switch e.Type {
+		case ContentTypeText:
+			if a.Text != e.Text {
+				t.Errorf("block %d: expected text %q, got %q", i, e.Text, a.Text)
+			}
+		case ContentTypeToolUse:
+			if a.ToolUse.Name != e.ToolUse.Name {
+				t.Errorf("block %d: expected tool %q, got %q", i, e.ToolUse.Name, a.ToolUse.Name)
+			}
+			if compactJSON(t, a.ToolUse.Input) != compactJSON(t, e.ToolUse.Input) {
+				t.Errorf("block %d: expected input %s, got %s", i, e.ToolUse.Input, a.ToolUse.Input)
+			}
+			if a.ToolUse.ID == "" || ids[a.ToolUse.ID] {
+				t.Errorf("block %d: expected unique tool call id, got %q", i, a.ToolUse.ID)
+			}
+			ids[a.ToolUse.ID] = true
+		}
+	}
+}
+
+func compactJSON(t *testing.T, data []byte) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		t.Errorf("invalid json %q: %v", data, err)
+	}
+
+	return buf.String()
+}
+
+func testProvider(providerType, baseURL string) Provider {
+	return Provider{
+		Type:    providerType,
+		Name:    providerType,
+		BaseURL: baseURL,
+		ApiKey:  "test-key",
+		Models:  []Model{{Name: contractModel}},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func claudeStandIn() standIn {
+	return standIn{
+		name:      "claude",
+		path:      "/v1/messages",
+		errorFlag: true,
+		toolIDs:   true,
+		newLLM: func(t *testing.T, baseURL string) LLM {
+			c, err := NewClaude(testProvider("claude", baseURL), contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create claude: %v", err)
+			}
+			return c
+		},
+		parse: func(t *testing.T, body []byte) wireRequest {
+			var req struct {
+				System []struct {
+					Text string `json:"text"`
+				} `json:"system"`
+				Messages []struct {
+					Role    Role `json:"role"`
+					Content []struct {
+						Type      ContentType     `json:"type"`
+						Text      string          `json:"text"`
+						ID        string          `json:"id"`
+						Name      string          `json:"name"`
+						Input     json.RawMessage `json:"input"`
+						ToolUseID string          `json:"tool_use_id"`
+						Content   []struct {
+							Text string `json:"text"`
+						} `json:"content"`
+						IsError bool `json:"is_error"`
+					} `json:"content"`
+				} `json:"messages"`
+				Tools []struct {
+					Name string `json:"name"`
+				} `json:"tools"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				t.Errorf("could not parse request: %v", err)
+			}
+
+			var wr wireRequest
+			for _, s := range req.System {
+				wr.System += s.Text
+			}
+			for _, tl := range req.Tools {
+				wr.Tools = append(wr.Tools, tl.Name)
+			}
+			for i, m := range req.Messages {
+				for _, c := range m.Content {
+					p := part{Turn: i, Role: m.Role, Type: c.Type}
+					switch c.Type {
+					case ContentTypeText:
+						p.Text = c.Text
+					case ContentTypeToolUse:
+						p.ToolID, p.ToolName, p.Input = c.ID, c.Name, compactJSON(t, c.Input)
+					case ContentTypeToolResult:
+						p.ToolID, p.Error = c.ToolUseID, c.IsError
+						for _, cc := range c.Content {
+							p.Text += cc.Text
+						}
+					}
+					wr.Parts = append(wr.Parts, p)
+				}
+			}
+			return wr
+		},
+		respond: func(w http.ResponseWriter, resp Message) {
+			content := make([]map[string]any, 0)
+			for _, b := range resp.Content {
+				switch b.Type {
+				case ContentTypeText:
+					content = append(content, map[string]any{"type": "text", "text": b.Text})
+				case ContentTypeToolUse:
+					content = append(content, map[string]any{
+						"type":  "tool_use",
+						"id":    b.ToolUse.ID,
+						"name":  b.ToolUse.Name,
+						"input": b.ToolUse.Input,
+					})
+				}
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"id":          "msg_1",
+				"type":        "message",
+				"role":        "assistant",
+				"model":       contractModel,
+				"content":     content,
+				"stop_reason": "end_turn",
+				"usage":       map[string]any{"input_tokens": 10, "output_tokens": 5},
+			})
+		},
+		respondError: func(w http.ResponseWriter) {
+			writeJSON(w, http.StatusBadRequest, map[string]any{
+				"type":  "error",
+				"error": map[string]any{"type": "invalid_request_error", "message": contractErrorMessage},
+			})
+		},
+	}
+}
+
+func openAIStandIn() standIn {
+	return standIn{
+		name:    "openai",
+		path:    "/v1/chat/completions",
+		toolIDs: true,
+		newLLM: func(t *testing.T, baseURL string) LLM {
+			o, err := NewOpenAI(testProvider("openai", baseURL+"/v1"), contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create openai: %v", err)
+			}
+			return o
+		},
+		parse: func(t *testing.T, body []byte) wireRequest {
+			var req struct {
+				Messages []struct {
+					Role      string `json:"role"`
+					Content   string `json:"content"`
+					ToolCalls []struct {
+						ID       string `json:"id"`
+						Function struct {
+							Name      string `json:"name"`
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+					ToolCallID string `json:"tool_call_id"`
+				} `json:"messages"`
+				Tools []struct {
+					Function struct {
+						Name string `json:"name"`
+					} `json:"function"`
+				} `json:"tools"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				t.Errorf("could not parse request: %v", err)
+			}
+
+			var wr wireRequest
+			for _, tl := range req.Tools {
+				wr.Tools = append(wr.Tools, tl.Function.Name)
+			}
+			turn, prevRole := -1, ""
+			for i, m := range req.Messages {
+				if m.Role != "system" && (m.Role != "tool" || prevRole != "tool") {
+					turn++
+				}
+				prevRole = m.Role
+				switch {
+				case m.Role == "system":
+					if i != 0 {
+						t.Errorf("expected system message first, found at %d", i)
+					}
+					wr.System += m.Content
+				case m.Role == "tool":
+					wr.Parts = append(wr.Parts, part{Turn: turn, Role: RoleUser, Type: ContentTypeToolResult, ToolID: m.ToolCallID, Text: m.Content})
+				default:
+					if m.Content != "" {
+						wr.Parts = append(wr.Parts, part{Turn: turn, Role: Role(m.Role), Type: ContentTypeText, Text: m.Content})
+					}
+					for _, tc := range m.ToolCalls {
+						wr.Parts = append(wr.Parts, part{
+							Turn:     turn,
+							Role:     Role(m.Role),
+							Type:     ContentTypeToolUse,
+							ToolID:   tc.ID,
+							ToolName: tc.Function.Name,
+							Input:    compactJSON(t, []byte(tc.Function.Arguments)),
+						})
+					}
+				}
+			}
+			return wr
+		},
+		respond: func(w http.ResponseWriter, resp Message) {
+			msg := map[string]any{"role": "assistant"}
+			calls := make([]map[string]any, 0)
+			for _, b := range resp.Content {
+				switch b.Type {
+				case ContentTypeText:
+					msg["content"] = b.Text
+				case ContentTypeToolUse:
+					calls = append(calls, map[string]any{
+						"id":       b.ToolUse.ID,
+						"type":     "function",
+						"function": map[string]any{"name": b.ToolUse.Name, "arguments": string(b.ToolUse.Input)},
+					})
+				}
+			}
+			if len(calls) > 0 {
+				msg["tool_calls"] = calls
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"id":      "chatcmpl-1",
+				"object":  "chat.completion",
+				"model":   contractModel,
+				"choices": []map[string]any{{"index": 0, "message": msg, "finish_reason": "stop"}},
+				"usage":   map[string]any{"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15},
+			})
+		},
+		respondError: func(w http.ResponseWriter) {
+			writeJSON(w, http.StatusBadRequest, map[string]any{
+				"error": map[string]any{"type": "invalid_request_error", "message": contractErrorMessage},
+			})
+		},
+	}
+}
+
+// localStandIn emulates a local server with native tool support, which has
+// the same wire format as openai.
+func localStandIn() standIn {
+	si := openAIStandIn()
+	si.name = "local"
+	si.newLLM = func(t *testing.T, baseURL string) LLM {
+		l, err := NewLocal(testProvider("local", baseURL+"/v1"), contractModel, contractSystemPrompt)
+		if err != nil {
+			t.Fatalf("could not create local: %v", err)
+		}
+		return l
+	}
+
+	return si
+}
+
+func ollamaStandIn() standIn {
+	return standIn{
+		name: "ollama",
+		path: "/api/chat",
+		newLLM: func(t *testing.T, baseURL string) LLM {
+			o, err := NewOllama(testProvider("ollama", baseURL), contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create ollama: %v", err)
+			}
+			return o
+		},
+		parse: func(t *testing.T, body []byte) wireRequest {
+			var req struct {
+				Messages []struct {
+					Role      string `json:"role"`
+					Content   string `json:"content"`
+					ToolCalls []struct {
+						Function struct {
+							Name      string          `json:"name"`
+							Arguments json.RawMessage `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+					ToolName string `json:"tool_name"`
+				} `json:"messages"`
+				Tools []struct {
+					Function struct {
+						Name string `json:"name"`
+					} `json:"function"`
+				} `json:"tools"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				t.Errorf("could not parse request: %v", err)
+			}
+
+			var wr wireRequest
+			for _, tl := range req.Tools {
+				wr.Tools = append(wr.Tools, tl.Function.Name)
+			}
+			turn, prevRole := -1, ""
+			for i, m := range req.Messages {
+				if m.Role != "system" && (m.Role != "tool" || prevRole != "tool") {
+					turn++
+				}
+				prevRole = m.Role
+				switch {
+				case m.Role == "system":
+					if i != 0 {
+						t.Errorf("expected system message first, found at %d", i)
+					}
+					wr.System += m.Content
+				case m.Role == "tool":
+					wr.Parts = append(wr.Parts, part{Turn: turn, Role: RoleUser, Type: ContentTypeToolResult, ToolName: m.ToolName, Text: m.Content})
+				default:
+					if m.Content != "" {
+						wr.Parts = append(wr.Parts, part{Turn: turn, Role: Role(m.Role), Type: ContentTypeText, Text: m.Content})
+					}
+					for _, tc := range m.ToolCalls {
+						wr.Parts = append(wr.Parts, part{
+							Turn:     turn,
+							Role:     Role(m.Role),
+							Type:     ContentTypeToolUse,
+							ToolName: tc.Function.Name,
+							Input:    compactJSON(t, tc.Function.Arguments),
+						})
+					}
+				}
+			}
+			return wr
+		},
+		respond: func(w http.ResponseWriter, resp Message) {
+			msg := map[string]any{"role": "assistant", "content": ""}
+			calls := make([]map[string]any, 0)
+			for _, b := range resp.Content {
+				switch b.Type {
+				case ContentTypeText:
+					msg["content"] = b.Text
+				case ContentTypeToolUse:
+					calls = append(calls, map[string]any{
+						"function": map[string]any{"name": b.ToolUse.Name, "arguments": b.ToolUse.Input},
+					})
+				}
+			}
+			if len(calls) > 0 {
+				msg["tool_calls"] = calls
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"model":             contractModel,
+				"message":           msg,
+				"done":              true,
+				"prompt_eval_count": 10,
+				"eval_count":        5,
+			})
+		},
+		respondError: func(w http.ResponseWriter) {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": contractErrorMessage})
+		},
+	}
+}
+
+func geminiStandIn() standIn {
+	return standIn{
+		name:      "gemini",
+		path:      "/v1beta/models/" + contractModel + ":generateContent",
+		errorFlag: true,
+		newLLM: func(t *testing.T, baseURL string) LLM {
+			g, err := NewGemini(testProvider("gemini", baseURL+"/v1beta"), contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create gemini: %v", err)
+			}
+			return g
+		},
+		parse: func(t *testing.T, body []byte) wireRequest {
+			type content struct {
+				Role  string `json:"role"`
+				Parts []struct {
+					Text         string `json:"text"`
+					FunctionCall *struct {
+						Name string          `json:"name"`
+						Args json.RawMessage `json:"args"`
+					} `json:"functionCall"`
+					FunctionResponse *struct {
+						Name     string `json:"name"`
+						Response struct {
+							Content *string `json:"content"`
+							Error   *string `json:"error"`
+						} `json:"response"`
+					} `json:"functionResponse"`
+				} `json:"parts"`
+			}
+			var req struct {
+				SystemInstruction content   `json:"systemInstruction"`
+				Contents          []content `json:"contents"`
+				Tools             []struct {
+					FunctionDeclarations []struct {
+						Name       string         `json:"name"`
+						Parameters map[string]any `json:"parameters"`
+					} `json:"functionDeclarations"`
+				} `json:"tools"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				t.Errorf("could not parse request: %v", err)
+			}
+
+			var wr wireRequest
+			for _, p := range req.SystemInstruction.Parts {
+				wr.System += p.Text
+			}
+			for _, tl := range req.Tools {
+				for _, fd := range tl.FunctionDeclarations {
+					if _, ok := fd.Parameters["additionalProperties"]; ok {
+						t.Errorf("gemini does not accept additionalProperties in the schema of %s", fd.Name)
+					}
+					wr.Tools = append(wr.Tools, fd.Name)
+				}
+			}
+			for i, c := range req.Contents {
+				role := RoleUser
+				if c.Role == "model" {
+					role = RoleAssistant
+				}
+				for _, p := range c.Parts {
+					switch {
+					case p.FunctionCall != nil:
+						wr.Parts = append(wr.Parts, part{Turn: i, Role: role, Type: ContentTypeToolUse, ToolName: p.FunctionCall.Name, Input: compactJSON(t, p.FunctionCall.Args)})
+					case p.FunctionResponse != nil:
+						fr := p.FunctionResponse
+						pt := part{Turn: i, Role: role, Type: ContentTypeToolResult, ToolName: fr.Name}
+						switch {
+						case fr.Response.Error != nil:
+							pt.Text, pt.Error = *fr.Response.Error, true
+						case fr.Response.Content != nil:
+							pt.Text = *fr.Response.Content
+						}
+						wr.Parts = append(wr.Parts, pt)
+					default:
+						wr.Parts = append(wr.Parts, part{Turn: i, Role: role, Type: ContentTypeText, Text: p.Text})
+					}
+				}
+			}
+			return wr
+		},
+		respond: func(w http.ResponseWriter, resp Message) {
+			parts := make([]map[string]any, 0)
+			for _, b := range resp.Content {
+				switch b.Type {
+				case ContentTypeText:
+					parts = append(parts, map[string]any{"text": b.Text})
+				case ContentTypeToolUse:
+					parts = append(parts, map[string]any{
+						"functionCall": map[string]any{"name": b.ToolUse.Name, "args": b.ToolUse.Input},
+					})
+				}
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"candidates": []map[string]any{{
+					"content":      map[string]any{"role": "model", "parts": parts},
+					"finishReason": "STOP",
+				}},
+				"usageMetadata": map[string]any{"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15},
+			})
+		},
+		respondError: func(w http.ResponseWriter) {
+			writeJSON(w, http.StatusBadRequest, map[string]any{
+				"error": map[string]any{"code": 400, "message": contractErrorMessage, "status": "INVALID_ARGUMENT"},
+			})
+		},
+	}
+}
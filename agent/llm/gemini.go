@@ -0,0 +1,375 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+const geminiBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+
+type Gemini struct {
+	provider       Provider
+	modelName      string
+	modelShortName string
+	systemPrompt   string
+	baseURL        string
+	params         Params
+	client         *http.Client
+}
+
+func NewGemini(provider Provider, modelName, systemPrompt string) (*Gemini, error) {
+	m, ok := provider.Model(modelName)
+	if !ok {
+		return nil, fmt.Errorf("%w: could not find model %q in provider %q", ErrUnknownModel, modelName, provider.Name)
+	}
+	baseURL := provider.BaseURL
+	if baseURL == "" {
+		baseURL = geminiBaseURL
+	}
+
+	return &Gemini{
+		provider:       provider,
+		modelName:      m.Name,
+		modelShortName: m.ShortName,
+		systemPrompt:   systemPrompt,
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		params:         m.Params,
+		client:         &http.Client{},
+	}, nil
+}
+
+func (g *Gemini) ModelInfo() (string, string, string) {
+	return g.provider.Name, g.modelName, g.modelShortName
+}
+
+func (g *Gemini) RunInference(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
+	// Gemini links function responses to calls by the name of the function
+	toolNames := make(map[string]string)
+	contents := make([]geminiContent, 0, len(conversation))
+	for _, msg := range conversation {
+		var role string
+		switch msg.Role {
+		case RoleUser:
+			role = "user"
+		case RoleAssistant:
+			role = "model"
+		default:
+			return Message{}, fmt.Errorf("unknown message role: %s", msg.Role)
+		}
+
+		parts := make([]geminiPart, 0, len(msg.Content))
+		for _, block := range msg.Content {
+			switch block.Type {
+			case ContentTypeText:
+				parts = append(parts, geminiPart{Text: block.Text})
+			case ContentTypeToolUse:
+				tu := block.ToolUse
+				toolNames[tu.ID] = tu.Name
+				args := tu.Input
+				if len(args) == 0 {
+					args = json.RawMessage("{}")
+				}
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: tu.Name,
+					Args: args,
+				}})
+			case ContentTypeToolResult:
+				tr := block.ToolResult
+				response := map[string]string{"content": tr.Result}
+				if tr.Error {
+					response = map[string]string{"error": tr.Result}
+				}
+				parts = append(parts, geminiPart{FunctionResponse: &geminiFunctionResponse{
+					Name:     toolNames[tr.ID],
+					Response: response,
+				}})
+				for _, img := range tr.Images {
+					parts = append(parts, geminiPart{InlineData: &geminiBlob{
+						MimeType: img.MediaType,
+						Data:     img.Base64(),
+					}})
+				}
+			case ContentTypeImage:
+				parts = append(parts, geminiPart{InlineData: &geminiBlob{
+					MimeType: block.Image.MediaType,
+					Data:     block.Image.Base64(),
+				}})
+			case ContentTypeThinking:
+				// reasoning is not sent back to the model
+			default:
+				return Message{}, fmt.Errorf("unknown message content type: %s", block.Type)
+			}
+		}
+
+		// an answer with only thinking has nothing left, and Gemini refuses
+		// empty messages
+		if len(parts) == 0 {
+			continue
+		}
+		// consecutive messages of the same role, like separately stored tool
+		// results, are sent as one
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, geminiContent{Role: role, Parts: parts})
+	}
+
+	declarations := make([]geminiFunctionDeclaration, 0, len(tools))
+	for _, t := range tools {
+		params, err := geminiSchema(t)
+		if err != nil {
+			return Message{}, err
+		}
+		declarations = append(declarations, geminiFunctionDeclaration{
+			Name:        t.Name(),
+			Description: t.Description(),
+			Parameters:  params,
+		})
+	}
+
+	request := geminiRequest{
+		SystemInstruction: &geminiContent{Parts: []geminiPart{{Text: g.systemPrompt}}},
+		Contents:          contents,
+		GenerationConfig: geminiGenerationConfig{
+			MaxOutputTokens: g.params.MaxTokens,
+			Temperature:     g.params.Temperature,
+			TopP:            g.params.TopP,
+			TopK:            g.params.TopK,
+			Seed:            g.params.Seed,
+			StopSequences:   g.params.Stop,
+			extra:           g.params.Extra,
+		},
+	}
+	if budget := g.params.ThinkingBudget; budget != nil {
+		request.GenerationConfig.ThinkingConfig = &geminiThinkingConfig{
+			ThinkingBudget:  *budget,
+			IncludeThoughts: *budget > 0,
+		}
+	}
+	if len(declarations) > 0 {
+		request.Tools = []geminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	resp, err := g.makeRequest(ctx, request)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return g.convertResponse(resp)
+}
+
+func (g *Gemini) makeRequest(ctx context.Context, request geminiRequest) (*geminiResponse, error) {
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/models/%s:generateContent", g.baseURL, url.PathEscape(g.modelName))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", g.provider.ApiKey)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp)
+	}
+
+	var response geminiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &response, nil
+}
+
+func (g *Gemini) convertResponse(resp *geminiResponse) (Message, error) {
+	if len(resp.Candidates) == 0 {
+		if resp.PromptFeedback.BlockReason != "" {
+			return Message{}, fmt.Errorf("prompt was blocked: %s", resp.PromptFeedback.BlockReason)
+		}
+		return Message{}, fmt.Errorf("response has no candidates")
+	}
+
+	message := Message{
+		Role:    RoleAssistant,
+		Content: make([]ContentBlock, 0),
+		Usage: Usage{
+			InputTokens:  resp.UsageMetadata.PromptTokenCount,
+			OutputTokens: resp.UsageMetadata.CandidatesTokenCount,
+		},
+	}
+	var text strings.Builder
+	flushText := func() {
+		if strings.TrimSpace(text.String()) != "" {
+			message.Content = append(message.Content, ContentBlock{
+				Type: ContentTypeText,
+				Text: text.String(),
+			})
+		}
+		text.Reset()
+	}
+	for _, p := range resp.Candidates[0].Content.Parts {
+		if p.Thought {
+			flushText()
+			message.Content = appendThinking(message.Content, p.Text)
+			continue
+		}
+		if p.FunctionCall == nil {
+			text.WriteString(p.Text)
+			continue
+		}
+		flushText()
+		id, err := newToolCallID()
+		if err != nil {
+			return Message{}, err
+		}
+		args := p.FunctionCall.Args
+		if len(args) == 0 {
+			args = json.RawMessage("{}")
+		}
+		message.Content = append(message.Content, ContentBlock{
+			Type: ContentTypeToolUse,
+			ToolUse: ToolUse{
+				ID:    id,
+				Name:  p.FunctionCall.Name,
+				Input: args,
+			},
+		})
+	}
+	flushText()
+
+	return message, nil
+}
+
+// geminiSchema converts the input schema of the tool to the subset of OpenAPI
+// that Gemini accepts for function parameters.
+func geminiSchema(t tool.Tool) (map[string]any, error) {
+	data, err := json.Marshal(t.InputSchema())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tool schema: %w", err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tool schema: %w", err)
+	}
+	stripUnsupported(schema)
+	if props, ok := schema["properties"].(map[string]any); ok && len(props) == 0 {
+		delete(schema, "properties")
+	}
+
+	return schema, nil
+}
+
+func stripUnsupported(v any) {
+	switch val := v.(type) {
+	case map[string]any:
+		for _, key := range []string{"$schema", "$id", "additionalProperties"} {
+			delete(val, key)
+		}
+		for _, sub := range val {
+			stripUnsupported(sub)
+		}
+	case []any:
+		for _, sub := range val {
+			stripUnsupported(sub)
+		}
+	}
+}
+
+type geminiRequest struct {
+	SystemInstruction *geminiContent         `json:"systemInstruction,omitempty"`
+	Contents          []geminiContent        `json:"contents"`
+	Tools             []geminiTool           `json:"tools,omitempty"`
+	GenerationConfig  geminiGenerationConfig `json:"generationConfig,omitzero"`
+}
+
+// geminiGenerationConfig holds the parameters. Extra parameters, like
+// thinkingConfig, are added to it.
+type geminiGenerationConfig struct {
+	MaxOutputTokens *int                  `json:"maxOutputTokens,omitempty"`
+	Temperature     *float64              `json:"temperature,omitempty"`
+	TopP            *float64              `json:"topP,omitempty"`
+	TopK            *int                  `json:"topK,omitempty"`
+	Seed            *int                  `json:"seed,omitempty"`
+	StopSequences   []string              `json:"stopSequences,omitempty"`
+	ThinkingConfig  *geminiThinkingConfig `json:"thinkingConfig,omitempty"`
+	extra           map[string]any        `json:"-"`
+}
+
+type geminiThinkingConfig struct {
+	ThinkingBudget  int  `json:"thinkingBudget"`
+	IncludeThoughts bool `json:"includeThoughts,omitempty"`
+}
+
+func (gc geminiGenerationConfig) MarshalJSON() ([]byte, error) {
+	type plain geminiGenerationConfig
+	return marshalWithExtra(plain(gc), gc.extra)
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFunctionCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string            `json:"name"`
+	Response map[string]string `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+}
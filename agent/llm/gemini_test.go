@@ -0,0 +1,101 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGeminiRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		resp    string
+		expErr  string
+		expText string
+	}{
+		{
+			name:    "text in parts",
+			resp:    `{"candidates":[{"content":{"role":"model","parts":[{"text":"Hello, "},{"text":"world"}]}}]}`,
+			expText: "Hello, world",
+		},
+		{
+			name:   "blocked",
+			resp:   `{"promptFeedback":{"blockReason":"SAFETY"}}`,
+			expErr: "prompt was blocked: SAFETY",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if key := r.Header.Get("x-goog-api-key"); key != "test-key" {
+					t.Errorf("expected api key in header, got %q", key)
+				}
+				if key := r.URL.Query().Get("key"); key != "" {
+					t.Errorf("expected no api key in url, got %q", key)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tc.resp))
+			}))
+			defer srv.Close()
+
+			g, err := NewLLM(testProvider("gemini", srv.URL), contractModel, "")
+			if err != nil {
+				t.Fatalf("could not create gemini: %v", err)
+			}
+			msg, err := g.RunInference(context.Background(), nil, []Message{{
+				Role:    RoleUser,
+				Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}},
+			}})
+			if tc.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+					t.Errorf("expected error %q, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(msg.Content) != 1 || msg.Content[0].Text != tc.expText {
+				t.Errorf("expected text %q, got %+v", tc.expText, msg.Content)
+			}
+		})
+	}
+}
+
+// TestGeminiThinkingOnly checks that an answer with only thinking is left
+// out, instead of being sent without parts.
+func TestGeminiThinkingOnly(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("could not parse request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"ok"}]}}]}`))
+	}))
+	defer srv.Close()
+
+	g, err := NewLLM(testProvider("gemini", srv.URL), contractModel, "")
+	if err != nil {
+		t.Fatalf("could not create gemini: %v", err)
+	}
+	if _, err := g.RunInference(context.Background(), nil, []Message{
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeThinking, Thinking: Thinking{Text: "hmm"}}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "hello?"}}},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	contents, _ := body["contents"].([]any)
+	if len(contents) != 1 {
+		t.Fatalf("expected one user message, got %v", contents)
+	}
+	if act := dig(contents, 0, "parts", 1, "text"); act != "hello?" {
+		t.Errorf("expected both questions, got %v", contents)
+	}
+}
@@ -0,0 +1,187 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// dig walks into decoded JSON with map keys and slice indexes.
+func dig(v any, path ...any) any {
+	for _, p := range path {
+		switch k := p.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil
+			}
+			v = m[k]
+		case int:
+			s, ok := v.([]any)
+			if !ok || k >= len(s) {
+				return nil
+			}
+			v = s[k]
+		}
+	}
+
+	return v
+}
+
+// TestImageInRequest checks that every provider sends an image of the user
+// together with the question.
+func TestImageInRequest(t *testing.T) {
+	img := Image{MediaType: "image/png", Data: []byte("not really a png")}
+	b64 := img.Base64()
+	for _, tc := range []struct {
+		si       standIn
+		path     string
+		textPath []any
+		imgPath  []any
+		expImg   string
+	}{
+		{
+			si:       claudeStandIn(),
+			textPath: []any{"messages", 0, "content", 0, "text"},
+			imgPath:  []any{"messages", 0, "content", 1, "source", "data"},
+			expImg:   b64,
+		},
+		{
+			si:       openAIStandIn(),
+			path:     "/v1",
+			textPath: []any{"messages", 1, "content", 0, "text"},
+			imgPath:  []any{"messages", 1, "content", 1, "image_url", "url"},
+			expImg:   img.DataURL(),
+		},
+		{
+			si:       localStandIn(),
+			path:     "/v1",
+			textPath: []any{"messages", 1, "content", 0, "text"},
+			imgPath:  []any{"messages", 1, "content", 1, "image_url", "url"},
+			expImg:   img.DataURL(),
+		},
+		{
+			si:       ollamaStandIn(),
+			textPath: []any{"messages", 1, "content"},
+			imgPath:  []any{"messages", 1, "images", 0},
+			expImg:   b64,
+		},
+		{
+			si:       geminiStandIn(),
+			path:     "/v1beta",
+			textPath: []any{"contents", 0, "parts", 0, "text"},
+			imgPath:  []any{"contents", 0, "parts", 1, "inlineData", "data"},
+			expImg:   b64,
+		},
+	} {
+		t.Run(tc.si.name, func(t *testing.T) {
+			var body map[string]any
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				if err := json.Unmarshal(data, &body); err != nil {
+					t.Errorf("could not parse request: %v", err)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				tc.si.respond(w, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "a cat"}}})
+			}))
+			defer srv.Close()
+
+			client, err := NewLLM(testProvider(tc.si.name, srv.URL+tc.path), contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create client: %v", err)
+			}
+			if _, err := client.RunInference(context.Background(), nil, []Message{{
+				Role: RoleUser,
+				Content: []ContentBlock{
+					{Type: ContentTypeText, Text: "what is this?"},
+					{Type: ContentTypeImage, Image: img},
+				},
+			}}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if act := dig(body, tc.textPath...); act != "what is this?" {
+				t.Errorf("expected question, got %v", act)
+			}
+			if act := dig(body, tc.imgPath...); act != tc.expImg {
+				t.Errorf("expected image %q, got %v", tc.expImg, act)
+			}
+		})
+	}
+}
+
+// TestImageInToolResult checks that every provider sends an image that a tool
+// returned, after the result of the call.
+func TestImageInToolResult(t *testing.T) {
+	img := Image{MediaType: "image/png", Data: []byte("not really a png")}
+	b64 := img.Base64()
+	for _, tc := range []struct {
+		si      standIn
+		path    string
+		imgPath []any
+		expImg  string
+	}{
+		{
+			si:      claudeStandIn(),
+			imgPath: []any{"messages", 2, "content", 0, "content", 1, "source", "data"},
+			expImg:  b64,
+		},
+		{
+			si:      openAIStandIn(),
+			path:    "/v1",
+			imgPath: []any{"messages", 4, "content", 0, "image_url", "url"},
+			expImg:  img.DataURL(),
+		},
+		{
+			si:      localStandIn(),
+			path:    "/v1",
+			imgPath: []any{"messages", 4, "content", 0, "image_url", "url"},
+			expImg:  img.DataURL(),
+		},
+		{
+			si:      ollamaStandIn(),
+			imgPath: []any{"messages", 4, "images", 0},
+			expImg:  b64,
+		},
+		{
+			si:      geminiStandIn(),
+			path:    "/v1beta",
+			imgPath: []any{"contents", 2, "parts", 1, "inlineData", "data"},
+			expImg:  b64,
+		},
+	} {
+		t.Run(tc.si.name, func(t *testing.T) {
+			var body map[string]any
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				if err := json.Unmarshal(data, &body); err != nil {
+					t.Errorf("could not parse request: %v", err)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				tc.si.respond(w, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "a cat"}}})
+			}))
+			defer srv.Close()
+
+			client, err := NewLLM(testProvider(tc.si.name, srv.URL+tc.path), contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create client: %v", err)
+			}
+			if _, err := client.RunInference(context.Background(), nil, []Message{
+				{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "what is in cat.png?"}}},
+				{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeToolUse, ToolUse: ToolUse{
+					ID: "call_1", Name: "read_file", Input: json.RawMessage(`{"path":"cat.png"}`),
+				}}}},
+				{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeToolResult, ToolResult: ToolResult{
+					ID: "call_1", Result: "cat.png is an image (image/png, 0 KB)", Images: []Image{img},
+				}}}},
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if act := dig(body, tc.imgPath...); act != tc.expImg {
+				t.Errorf("expected image %q, got %v", tc.expImg, act)
+			}
+		})
+	}
+}
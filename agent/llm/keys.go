@@ -0,0 +1,325 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+const redacted = "[redacted]"
+
+// apiKeyCommandTimeout limits the time a password manager may take, for
+// instance while it waits for a passphrase.
+var apiKeyCommandTimeout = time.Minute
+
+var (
+	commandMu sync.Mutex
+	// commandKeys caches the output of api_key_command, so that a password
+	// manager is not asked again for every new client.
+	commandKeys = make(map[string]string)
+
+	keysMu sync.Mutex
+	// secrets are all keys that were used, they are removed from errors.
+	secrets = make(map[string]bool)
+)
+
+// withKey returns the provider with its API key. Keys are resolved when a
+// client for the provider is made, not when the config is read, so that a
+// missing key only matters for a provider that is used.
+func (p Provider) withKey() (Provider, error) {
+	if p.ApiKey != "" {
+		remember(p.ApiKey)
+		return p, nil
+	}
+
+	var key string
+	var err error
+	switch {
+	case p.ApiKeyEnv != "":
+		val, ok := os.LookupEnv(p.ApiKeyEnv)
+		if !ok {
+			return Provider{}, fmt.Errorf("could not read environment variable %s for provider %s", p.ApiKeyEnv, p.Name)
+		}
+		key = val
+	case p.ApiKeyCommand != "":
+		key, err = commandKey(p.ApiKeyCommand)
+	case p.ApiKeyStored && p.KeyStore == nil:
+		return Provider{}, fmt.Errorf("provider %s uses a stored key, but there is no key store", p.Name)
+	case p.ApiKeyStored:
+		key, err = p.KeyStore.Key(p.Name)
+	default:
+		return p, nil
+	}
+	if err != nil {
+		return Provider{}, fmt.Errorf("could not get API key for provider %s: %w", p.Name, err)
+	}
+	p.ApiKey = key
+	remember(key)
+
+	return p, nil
+}
+
+// commandKey runs the command with the shell and returns the first line of
+// the output, which is where password managers like pass put the password.
+func commandKey(command string) (string, error) {
+	commandMu.Lock()
+	defer commandMu.Unlock()
+	if key, ok := commandKeys[command]; ok {
+		return key, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiKeyCommandTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stderr = &stderr
+	// without this, a child of the shell that keeps stderr open would make
+	// Output wait after the timeout
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("api_key_command did not finish within %s", apiKeyCommandTimeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("api_key_command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	key, _, _ := strings.Cut(string(out), "\n")
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", errors.New("api_key_command returned nothing")
+	}
+	commandKeys[command] = key
+
+	return key, nil
+}
+
+func remember(key string) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	secrets[key] = true
+}
+
+// Redact replaces the API keys that were used in s.
+func Redact(s string) string {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	for key := range secrets {
+		// very short keys would redact ordinary words
+		if len(key) >= 8 {
+			s = strings.ReplaceAll(s, key, redacted)
+		}
+	}
+
+	return s
+}
+
+// redactedError hides the API keys in the message of an error, but keeps
+// the error itself available for errors.Is and errors.As.
+type redactedError struct {
+	err error
+}
+
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &redactedError{err: err}
+}
+
+func (e *redactedError) Error() string { return Redact(e.err.Error()) }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redacting removes the API keys from the errors of a client. Some SDKs put
+// the request, with its headers, in their errors.
+type redacting struct {
+	LLM
+}
+
+func (r redacting) RunInference(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
+	msg, err := r.LLM.RunInference(ctx, tools, conversation)
+
+	return msg, redactError(err)
+}
+
+const (
+	keyStoreIterations = 600_000
+	keyStoreSaltSize   = 16
+)
+
+// KeyStore keeps API keys in a file that is encrypted with a passphrase, for
+// systems without a keyring or password manager. The file is decrypted once,
+// the first time a key is needed.
+type KeyStore struct {
+	path       string
+	passphrase func() (string, error)
+	mu         sync.Mutex
+	secret     string
+	keys       map[string]string
+}
+
+// NewKeyStore uses the file at path. Passphrase is called when the file has
+// to be decrypted or encrypted.
+func NewKeyStore(path string, passphrase func() (string, error)) *KeyStore {
+	return &KeyStore{
+		path:       path,
+		passphrase: passphrase,
+	}
+}
+
+type keyStoreFile struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// Key returns the key that is stored for the provider.
+func (ks *KeyStore) Key(provider string) (string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if err := ks.load(); err != nil {
+		return "", err
+	}
+	key, ok := ks.keys[provider]
+	if !ok {
+		return "", fmt.Errorf("no key stored for %s in %s", provider, ks.path)
+	}
+
+	return key, nil
+}
+
+// Providers lists the providers that have a key in the store.
+func (ks *KeyStore) Providers() ([]string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+
+	return slices.Sorted(maps.Keys(ks.keys)), nil
+}
+
+// Set stores the key for the provider. An empty key removes it.
+func (ks *KeyStore) Set(provider, key string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if err := ks.load(); err != nil {
+		return err
+	}
+	if key == "" {
+		delete(ks.keys, provider)
+	} else {
+		ks.keys[provider] = key
+	}
+
+	return ks.save()
+}
+
+func (ks *KeyStore) load() error {
+	if ks.keys != nil {
+		return nil
+	}
+	data, err := os.ReadFile(ks.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		ks.keys = make(map[string]string)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read key store: %w", err)
+	}
+	var file keyStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("could not parse key store: %w", err)
+	}
+	gcm, err := ks.cipher(file.Salt)
+	if err != nil {
+		return err
+	}
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		ks.secret = ""
+		return errors.New("could not decrypt key store, wrong passphrase?")
+	}
+	keys := make(map[string]string)
+	if err := json.Unmarshal(plain, &keys); err != nil {
+		return fmt.Errorf("could not parse key store: %w", err)
+	}
+	for _, key := range keys {
+		remember(key)
+	}
+	ks.keys = keys
+
+	return nil
+}
+
+// save encrypts the keys with a new salt and nonce. The file is written next
+// to the old one first, so that a failure does not lose the keys.
+func (ks *KeyStore) save() error {
+	plain, err := json.Marshal(ks.keys)
+	if err != nil {
+		return fmt.Errorf("could not marshal keys: %w", err)
+	}
+	file := keyStoreFile{Salt: make([]byte, keyStoreSaltSize)}
+	rand.Read(file.Salt)
+	gcm, err := ks.cipher(file.Salt)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, gcm.NonceSize())
+	rand.Read(file.Nonce)
+	file.Data = gcm.Seal(nil, file.Nonce, plain, nil)
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("could not marshal key store: %w", err)
+	}
+	tmp := ks.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("could not write key store: %w", err)
+	}
+	if err := os.Rename(tmp, ks.path); err != nil {
+		return fmt.Errorf("could not write key store: %w", err)
+	}
+
+	return nil
+}
+
+func (ks *KeyStore) cipher(salt []byte) (cipher.AEAD, error) {
+	if ks.secret == "" {
+		passphrase, err := ks.passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("could not get passphrase: %w", err)
+		}
+		if passphrase == "" {
+			return nil, errors.New("passphrase is empty")
+		}
+		ks.secret = passphrase
+	}
+	key, err := pbkdf2.Key(sha256.New, ks.secret, salt, keyStoreIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
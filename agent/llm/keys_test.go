@@ -0,0 +1,140 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProviderKey(t *testing.T) {
+	store := NewKeyStore(filepath.Join(t.TempDir(), "keys.enc"), func() (string, error) { return "pass", nil })
+	if err := store.Set("stored", "key-from-store"); err != nil {
+		t.Fatalf("could not store key: %v", err)
+	}
+	t.Setenv("HENK_TEST_KEY", "key-from-env")
+
+	for _, tc := range []struct {
+		name     string
+		provider Provider
+		exp      string
+		expErr   string
+	}{
+		{name: "none", provider: Provider{Name: "ollama"}},
+		{name: "plain", provider: Provider{Name: "p", ApiKey: "key"}, exp: "key"},
+		{name: "env", provider: Provider{Name: "p", ApiKeyEnv: "HENK_TEST_KEY"}, exp: "key-from-env"},
+		{name: "missing env", provider: Provider{Name: "p", ApiKeyEnv: "HENK_TEST_MISSING"}, expErr: "HENK_TEST_MISSING"},
+		{name: "command", provider: Provider{Name: "p", ApiKeyCommand: "printf 'key-from-command\\nusername: henk\\n'"}, exp: "key-from-command"},
+		{name: "failing command", provider: Provider{Name: "p", ApiKeyCommand: "echo locked >&2; exit 1"}, expErr: "locked"},
+		{name: "stored", provider: Provider{Name: "stored", ApiKeyStored: true, KeyStore: store}, exp: "key-from-store"},
+		{name: "not stored", provider: Provider{Name: "other", ApiKeyStored: true, KeyStore: store}, expErr: "no key stored for other"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := tc.provider.withKey()
+			if tc.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+					t.Errorf("expected error with %q, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.ApiKey != tc.exp {
+				t.Errorf("expected key %q, got %q", tc.exp, p.ApiKey)
+			}
+		})
+	}
+}
+
+func TestCommandKeyTimeout(t *testing.T) {
+	old := apiKeyCommandTimeout
+	apiKeyCommandTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { apiKeyCommandTimeout = old })
+
+	start := time.Now()
+	_, err := commandKey("sleep 10")
+	if err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected the command to be stopped, it took %s", d)
+	}
+}
+
+func TestKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.enc")
+	asked := 0
+	store := NewKeyStore(path, func() (string, error) {
+		asked++
+		return "pass", nil
+	})
+	if err := store.Set("a", "key-a"); err != nil {
+		t.Fatalf("could not store key: %v", err)
+	}
+	if err := store.Set("b", "key-b"); err != nil {
+		t.Fatalf("could not store key: %v", err)
+	}
+	if err := store.Set("a", ""); err != nil {
+		t.Fatalf("could not remove key: %v", err)
+	}
+	if asked != 1 {
+		t.Errorf("expected the passphrase to be asked once, got %d", asked)
+	}
+
+	reopened := NewKeyStore(path, func() (string, error) { return "pass", nil })
+	providers, err := reopened.Providers()
+	if err != nil || strings.Join(providers, ",") != "b" {
+		t.Errorf("expected only b, got %v, %v", providers, err)
+	}
+	if key, err := reopened.Key("b"); err != nil || key != "key-b" {
+		t.Errorf("expected key-b, got %q, %v", key, err)
+	}
+
+	wrong := NewKeyStore(path, func() (string, error) { return "wrong", nil })
+	if _, err := wrong.Key("b"); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("expected a wrong passphrase, got %v", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	const key = "sk-secret-key-that-leaks"
+	// a server that echoes the authorization header in its error
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"error": map[string]any{"message": "bad request with " + r.Header.Get("Authorization")},
+		})
+	}))
+	defer srv.Close()
+
+	provider := testProvider("local", srv.URL)
+	provider.ApiKey = ""
+	provider.ApiKeyCommand = "echo " + key
+	client, err := NewLLM(provider, contractModel, contractSystemPrompt)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	_, err = client.RunInference(context.Background(), nil, []Message{{
+		Role:    RoleUser,
+		Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}},
+	}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if strings.Contains(err.Error(), key) || !strings.Contains(err.Error(), "Bearer [redacted]") {
+		t.Errorf("expected the key to be redacted, got %q", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+		t.Errorf("expected the API error to be kept, got %v", err)
+	}
+
+	_, err = ListModels(context.Background(), provider)
+	if err == nil || strings.Contains(err.Error(), key) {
+		t.Errorf("expected a redacted error, got %v", err)
+	}
+}
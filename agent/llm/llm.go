@@ -2,9 +2,11 @@ package llm
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 
 	"go-mod.ewintr.nl/henk/agent/tool"
 )
@@ -24,6 +26,8 @@ const (
 	ContentTypeText       ContentType = "text"
 	ContentTypeToolUse    ContentType = "tool_use"
 	ContentTypeToolResult ContentType = "tool_result"
+	ContentTypeThinking   ContentType = "thinking"
+	ContentTypeImage      ContentType = "image"
 )
 
 type Role string
@@ -34,28 +38,158 @@ const (
 )
 
 type ToolUse struct {
-	ID    string
-	Name  string
-	Input json.RawMessage
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input,omitempty"`
 }
 
 type ToolResult struct {
-	ID     string
-	Result string
-	Error  bool
+	ID     string  `json:"id"`
+	Result string  `json:"result"`
+	Error  bool    `json:"error,omitempty"`
+	Images []Image `json:"images,omitempty"`
+}
+
+// Thinking is the reasoning of a model before it answers. Claude signs its
+// thinking and needs it back unchanged while it is calling tools. Thinking
+// that Claude redacted has only Redacted, which is encrypted.
+type Thinking struct {
+	Text      string `json:"text,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Redacted  string `json:"redacted,omitempty"`
+}
+
+// Image is a picture in the conversation, like a screenshot. MediaType is
+// image/png, image/jpeg, image/gif or image/webp.
+type Image struct {
+	MediaType string `json:"media_type"`
+	Data      []byte `json:"data"`
+}
+
+// Base64 is the data of the image as most APIs want it.
+func (i Image) Base64() string {
+	return base64.StdEncoding.EncodeToString(i.Data)
+}
+
+// DataURL is the image as a data URL, for APIs that take a URL.
+func (i Image) DataURL() string {
+	return fmt.Sprintf("data:%s;base64,%s", i.MediaType, i.Base64())
+}
+
+// errorResultPrefix marks failed tool results for APIs that have no field
+// for it.
+const errorResultPrefix = "error: "
+
+func toolResultContent(tr ToolResult) string {
+	if tr.Error {
+		return errorResultPrefix + tr.Result
+	}
+
+	return tr.Result
+}
+
+// toolInput converts the arguments of a tool call, as the model wrote them,
+// to an input that can always be stored and sent back. Arguments that are
+// not JSON become a JSON string, which fails the validation of the tool, so
+// that the model gets an error it can correct.
+func toolInput(args string) json.RawMessage {
+	switch {
+	case strings.TrimSpace(args) == "":
+		return json.RawMessage("{}")
+	case json.Valid([]byte(args)):
+		return json.RawMessage(args)
+	default:
+		data, _ := json.Marshal(args)
+		return data
+	}
+}
+
+const (
+	thinkOpen  = "<think>"
+	thinkClose = "</think>"
+)
+
+// splitThinking separates the reasoning in <think> tags, as written by models
+// like qwen3 and DeepSeek, from the answer. Some chat templates put the
+// opening tag in the prompt, so a closing tag at the start ends the reasoning
+// too. Reasoning that is cut off before the closing tag is still reasoning.
+func splitThinking(text string) (string, string) {
+	thinking := make([]string, 0)
+	var answer strings.Builder
+	rest := text
+	if end := strings.Index(rest, thinkClose); end >= 0 && !strings.Contains(rest[:end], thinkOpen) {
+		thinking = append(thinking, rest[:end])
+		rest = rest[end+len(thinkClose):]
+	}
+	for {
+		start := strings.Index(rest, thinkOpen)
+		if start < 0 {
+			answer.WriteString(rest)
+			break
+		}
+		answer.WriteString(rest[:start])
+		rest = rest[start+len(thinkOpen):]
+		end := strings.Index(rest, thinkClose)
+		if end < 0 {
+			thinking = append(thinking, rest)
+			break
+		}
+		thinking = append(thinking, rest[:end])
+		rest = rest[end+len(thinkClose):]
+	}
+	if len(thinking) == 0 {
+		return "", text
+	}
+	for i, t := range thinking {
+		thinking[i] = strings.TrimSpace(t)
+	}
+
+	return strings.TrimSpace(strings.Join(thinking, "\n\n")), strings.TrimSpace(answer.String())
+}
+
+// appendThinking adds the reasoning that is not empty to the content.
+func appendThinking(content []ContentBlock, reasoning ...string) []ContentBlock {
+	for _, r := range reasoning {
+		if r = strings.TrimSpace(r); r != "" {
+			content = append(content, ContentBlock{
+				Type:     ContentTypeThinking,
+				Thinking: Thinking{Text: r},
+			})
+		}
+	}
+
+	return content
 }
 
 type ContentBlock struct {
-	ID         string
-	Type       ContentType
-	Text       string
-	ToolUse    ToolUse
-	ToolResult ToolResult
+	ID         string      `json:"id,omitempty"`
+	Type       ContentType `json:"type"`
+	Text       string      `json:"text,omitempty"`
+	ToolUse    ToolUse     `json:"tool_use,omitzero"`
+	ToolResult ToolResult  `json:"tool_result,omitzero"`
+	Thinking   Thinking    `json:"thinking,omitzero"`
+	Image      Image       `json:"image,omitzero"`
+}
+
+// Usage is the number of tokens that were used to produce a message. With
+// prompt caching, InputTokens only counts the tokens that were not read from
+// or written to the cache.
+type Usage struct {
+	InputTokens      int `json:"input_tokens"`
+	OutputTokens     int `json:"output_tokens"`
+	CacheReadTokens  int `json:"cache_read_tokens,omitempty"`
+	CacheWriteTokens int `json:"cache_write_tokens,omitempty"`
+}
+
+// Total is the size of the conversation, including the answer.
+func (u Usage) Total() int {
+	return u.InputTokens + u.OutputTokens + u.CacheReadTokens + u.CacheWriteTokens
 }
 
 type Message struct {
-	Content []ContentBlock
-	Role    Role
+	Content []ContentBlock `json:"content"`
+	Role    Role           `json:"role"`
+	Usage   Usage          `json:"usage,omitzero"`
 }
 
 type Conversation struct{}
@@ -65,15 +199,41 @@ type Model struct {
 	ShortName   string `toml:"short_name"`
 	Default     bool   `toml:"default"`
 	ContextSize int    `toml:"context_size"`
+	Params      Params `toml:"params"`
+	// Vision tells whether the model can look at images. When it is set to
+	// false, images are refused before they are sent.
+	Vision *bool `toml:"vision"`
+	// PromptCache makes Claude cache the system prompt, the tools and the
+	// conversation, so they are not processed again every round. It is on
+	// unless it is set to false.
+	PromptCache *bool `toml:"prompt_cache"`
 }
 
 type Provider struct {
-	Type      string `toml:"type"`
-	BaseURL   string `toml:"base_url"`
-	ApiKey    string
-	ApiKeyEnv string  `toml:"api_key_env"`
-	Name      string  `toml:"name"`
-	Models    []Model `toml:"models"`
+	Type    string `toml:"type"`
+	BaseURL string `toml:"base_url"`
+	// The API key is taken from ApiKeyEnv, from the output of ApiKeyCommand
+	// or from the KeyStore, the first time a client for the provider is made.
+	ApiKey        string
+	ApiKeyEnv     string `toml:"api_key_env"`
+	ApiKeyCommand string `toml:"api_key_command"`
+	ApiKeyStored  bool   `toml:"api_key_stored"`
+	// KeyStore is set when the config is read.
+	KeyStore *KeyStore `toml:"-"`
+	Name     string    `toml:"name"`
+	Models   []Model   `toml:"models"`
+	// Fixture is the file with the responses for the replay provider.
+	Fixture string `toml:"fixture"`
+	// Record is a file to store all requests and responses in, so they can
+	// be used as fixture later.
+	Record string `toml:"record"`
+	// ToolCalling is how the local provider offers tools to the model:
+	// "native" uses the tools field of the API, "prompt" describes the tools
+	// in the system prompt, and "auto" uses native tools unless the server
+	// does not support them.
+	ToolCalling string `toml:"tool_calling"`
+	// Retry sets how failed requests are tried again.
+	Retry RetryConfig `toml:"retry"`
 }
 
 func (p Provider) Model(name string) (Model, bool) {
@@ -87,14 +247,35 @@ func (p Provider) Model(name string) (Model, bool) {
 }
 
 func NewLLM(provider Provider, modelName, systemPrompt string) (LLM, error) {
+	provider, err := provider.withKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var llm LLM
 	switch provider.Type {
 	case "claude":
-		return NewClaude(provider, modelName, systemPrompt)
+		llm, err = NewClaude(provider, modelName, systemPrompt)
 	case "openai":
-		return NewOpenAI(provider, modelName, systemPrompt)
+		llm, err = NewOpenAI(provider, modelName, systemPrompt)
 	case "ollama":
-		return NewOllama(provider, modelName, systemPrompt)
+		llm, err = NewOllama(provider, modelName, systemPrompt)
+	case "gemini":
+		llm, err = NewGemini(provider, modelName, systemPrompt)
+	case "local":
+		llm, err = NewLocal(provider, modelName, systemPrompt)
+	case "replay":
+		llm, err = NewReplay(provider, modelName)
 	default:
 		return nil, fmt.Errorf("unknown provider type: %s", provider.Type)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	if provider.Record != "" {
+		llm = NewRecorder(llm, provider.Record)
+	}
+
+	return redacting{LLM: llm}, nil
 }
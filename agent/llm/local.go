@@ -0,0 +1,450 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+const (
+	ToolCallingAuto   = "auto"
+	ToolCallingNative = "native"
+	ToolCallingPrompt = "prompt"
+)
+
+// Local talks to servers that run models locally and that have an API like
+// the chat completions of OpenAI, like llama-server and LM Studio. Not all of
+// them support tools, so tools can also be offered in the system prompt.
+type Local struct {
+	provider     Provider
+	model        Model
+	systemPrompt string
+	client       *http.Client
+	mu           sync.Mutex
+	// promptTools is set when the server turns out not to support tools
+	promptTools bool
+}
+
+func NewLocal(provider Provider, modelName, systemPrompt string) (*Local, error) {
+	m, ok := provider.Model(modelName)
+	if !ok {
+		return nil, fmt.Errorf("%w: could not find model %q in provider %q", ErrUnknownModel, modelName, provider.Name)
+	}
+	switch provider.ToolCalling {
+	case "", ToolCallingAuto, ToolCallingNative, ToolCallingPrompt:
+	default:
+		return nil, fmt.Errorf("unknown tool calling %q in provider %q", provider.ToolCalling, provider.Name)
+	}
+
+	return &Local{
+		provider:     provider,
+		model:        m,
+		systemPrompt: systemPrompt,
+		client:       &http.Client{},
+	}, nil
+}
+
+func (l *Local) ModelInfo() (string, string, string) {
+	return l.provider.Name, l.model.Name, l.model.ShortName
+}
+
+func (l *Local) RunInference(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
+	mode := l.provider.ToolCalling
+	if mode == "" {
+		mode = ToolCallingAuto
+	}
+	l.mu.Lock()
+	if mode == ToolCallingAuto && l.promptTools {
+		mode = ToolCallingPrompt
+	}
+	l.mu.Unlock()
+
+	request, err := l.request(tools, conversation, mode == ToolCallingPrompt)
+	if err != nil {
+		return Message{}, err
+	}
+	resp, err := l.makeRequest(ctx, request)
+	var apiErr *APIError
+	if err != nil && mode == ToolCallingAuto && len(tools) > 0 && errors.As(err, &apiErr) && aboutTools(apiErr) {
+		l.mu.Lock()
+		l.promptTools = true
+		l.mu.Unlock()
+		if request, err = l.request(tools, conversation, true); err != nil {
+			return Message{}, err
+		}
+		resp, err = l.makeRequest(ctx, request)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	return l.convertResponse(resp)
+}
+
+func (l *Local) request(tools []tool.Tool, conversation []Message, promptTools bool) (localRequest, error) {
+	system := l.systemPrompt
+	if promptTools && len(tools) > 0 {
+		prompt, err := toolPrompt(tools)
+		if err != nil {
+			return localRequest{}, err
+		}
+		system = fmt.Sprintf("%s\n\n%s", system, prompt)
+	}
+	messages := []localMessage{{Role: "system", Content: system}}
+
+	for _, msg := range conversation {
+		if msg.Role != RoleUser && msg.Role != RoleAssistant {
+			return localRequest{}, fmt.Errorf("unknown message role: %s", msg.Role)
+		}
+
+		var content strings.Builder
+		var images []string
+		var toolCalls []localToolCall
+		var toolResults []localMessage
+		for _, block := range msg.Content {
+			switch block.Type {
+			case ContentTypeText:
+				content.WriteString(block.Text)
+			case ContentTypeToolUse:
+				tu := block.ToolUse
+				args := tu.Input
+				if len(args) == 0 {
+					args = json.RawMessage("{}")
+				}
+				if promptTools {
+					fmt.Fprintf(&content, "\n<tool_call>\n{\"name\": %q, \"arguments\": %s}\n</tool_call>", tu.Name, args)
+					continue
+				}
+				toolCalls = append(toolCalls, localToolCall{
+					ID:   tu.ID,
+					Type: "function",
+					Function: localFunctionCall{
+						Name:      tu.Name,
+						Arguments: string(args),
+					},
+				})
+			case ContentTypeToolResult:
+				tr := block.ToolResult
+				// a tool message can only hold text, images follow in the
+				// message of the user
+				for _, img := range tr.Images {
+					images = append(images, img.DataURL())
+				}
+				if promptTools {
+					fmt.Fprintf(&content, "<tool_result>\n%s\n</tool_result>\n", toolResultContent(tr))
+					continue
+				}
+				toolResults = append(toolResults, localMessage{
+					Role:       "tool",
+					Content:    toolResultContent(tr),
+					ToolCallID: tr.ID,
+				})
+			case ContentTypeImage:
+				images = append(images, block.Image.DataURL())
+			case ContentTypeThinking:
+				// reasoning is not sent back to the model
+			default:
+				return localRequest{}, fmt.Errorf("unknown message content type: %s", block.Type)
+			}
+		}
+
+		messages = append(messages, toolResults...)
+		if content.Len() > 0 || len(images) > 0 || len(toolCalls) > 0 {
+			messages = append(messages, localMessage{
+				Role:      string(msg.Role),
+				Content:   strings.TrimSpace(content.String()),
+				Images:    images,
+				ToolCalls: toolCalls,
+			})
+		}
+	}
+
+	var localTools []localTool
+	if !promptTools {
+		for _, t := range tools {
+			localTools = append(localTools, localTool{
+				Type: "function",
+				Function: localFunction{
+					Name:        t.Name(),
+					Description: t.Description(),
+					Parameters:  t.InputSchema(),
+				},
+			})
+		}
+	}
+	toolsSize, err := json.Marshal(localTools)
+	if err != nil {
+		return localRequest{}, fmt.Errorf("failed to marshal tools: %w", err)
+	}
+
+	p := l.model.Params
+	return localRequest{
+		Model:         l.model.Name,
+		Messages:      l.fitContext(messages, estimateTokens(string(toolsSize))),
+		Tools:         localTools,
+		MaxTokens:     p.MaxTokens,
+		Temperature:   p.Temperature,
+		TopP:          p.TopP,
+		TopK:          p.TopK,
+		MinP:          p.MinP,
+		RepeatPenalty: p.RepeatPenalty,
+		Seed:          p.Seed,
+		Stop:          p.Stop,
+	}, nil
+}
+
+// fitContext drops the oldest messages until the conversation fits in the
+// context of the model, with room for the answer. The system prompt and the
+// last message are always kept.
+func (l *Local) fitContext(messages []localMessage, toolTokens int) []localMessage {
+	if l.model.ContextSize == 0 {
+		return messages
+	}
+	reserve := l.model.ContextSize / 4
+	if l.model.Params.MaxTokens != nil {
+		reserve = *l.model.Params.MaxTokens
+	}
+	limit := l.model.ContextSize - reserve - toolTokens
+
+	size := func(msgs []localMessage) int {
+		total := 0
+		for _, m := range msgs {
+			total += estimateTokens(m.Content)
+			for _, tc := range m.ToolCalls {
+				total += estimateTokens(tc.Function.Arguments)
+			}
+		}
+		return total
+	}
+	system, rest := messages[0], messages[1:]
+	for len(rest) > 1 && size(rest)+estimateTokens(system.Content) > limit {
+		rest = rest[1:]
+		// the conversation has to start with a message of the user, not with
+		// an answer or with tool results of a call that was dropped
+		for len(rest) > 1 && rest[0].Role != "user" {
+			rest = rest[1:]
+		}
+	}
+
+	return append([]localMessage{system}, rest...)
+}
+
+// estimateTokens is a rough guess, models have around four characters per
+// token for English text and code.
+func estimateTokens(s string) int {
+	return len(s)/4 + 1
+}
+
+// toolPrompt describes the tools for models that are not offered tools by
+// the API. The calls are read from the answer by parseTextToolCalls.
+func toolPrompt(tools []tool.Tool) (string, error) {
+	var b strings.Builder
+	b.WriteString(`# Tools
+
+You can use the tools below. To call a tool, add the call to your answer in exactly this form:
+
+<tool_call>
+{"name": "the name of the tool", "arguments": {"the": "input"}}
+</tool_call>
+
+You can make more than one call in an answer. Stop after the calls and wait for the results, they are sent to you in <tool_result> tags in the same order as the calls.
+`)
+	for _, t := range tools {
+		schema, err := json.Marshal(t.InputSchema())
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal tool schema: %w", err)
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n\nInput schema: %s\n", t.Name(), t.Description(), schema)
+	}
+
+	return b.String(), nil
+}
+
+func (l *Local) makeRequest(ctx context.Context, request localRequest) (*localResponse, error) {
+	jsonData, err := marshalWithExtra(request, l.model.Params.Extra)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/chat/completions", strings.TrimSuffix(l.provider.BaseURL, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.provider.ApiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+l.provider.ApiKey)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp)
+	}
+
+	var response localResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &response, nil
+}
+
+func (l *Local) convertResponse(resp *localResponse) (Message, error) {
+	if len(resp.Choices) == 0 {
+		return Message{}, fmt.Errorf("response has no choices")
+	}
+	message := Message{
+		Role:    RoleAssistant,
+		Content: make([]ContentBlock, 0),
+		Usage: Usage{
+			InputTokens:  resp.Usage.PromptTokens,
+			OutputTokens: resp.Usage.CompletionTokens,
+		},
+	}
+
+	// llama-server returns the reasoning in a separate field, other servers
+	// leave it in the text between <think> tags
+	msg := resp.Choices[0].Message
+	thinking, text := splitThinking(msg.Content)
+	message.Content = appendThinking(message.Content, msg.ReasoningContent, thinking)
+	calls := make([]ToolUse, 0, len(msg.ToolCalls))
+	for _, tc := range msg.ToolCalls {
+		calls = append(calls, ToolUse{ID: tc.ID, Name: tc.Function.Name, Input: toolInput(tc.Function.Arguments)})
+	}
+	// models without native support write the calls in the text
+	if len(calls) == 0 {
+		var textCalls []ollamaToolCall
+		text, textCalls = parseTextToolCalls(text)
+		for _, tc := range textCalls {
+			calls = append(calls, ToolUse{Name: tc.Function.Name, Input: tc.Function.Arguments})
+		}
+	}
+
+	if strings.TrimSpace(text) != "" {
+		message.Content = append(message.Content, ContentBlock{
+			Type: ContentTypeText,
+			Text: text,
+		})
+	}
+	for _, call := range calls {
+		if call.ID == "" {
+			var err error
+			if call.ID, err = newToolCallID(); err != nil {
+				return Message{}, err
+			}
+		}
+		if len(call.Input) == 0 {
+			call.Input = json.RawMessage("{}")
+		}
+		message.Content = append(message.Content, ContentBlock{
+			Type:    ContentTypeToolUse,
+			ToolUse: call,
+		})
+	}
+
+	return message, nil
+}
+
+// aboutTools tells whether the server refused the request because of the
+// tools.
+func aboutTools(e *APIError) bool {
+	return e.Status >= 400 && strings.Contains(strings.ToLower(e.Message), "tool")
+}
+
+type localRequest struct {
+	Model         string         `json:"model"`
+	Messages      []localMessage `json:"messages"`
+	Tools         []localTool    `json:"tools,omitempty"`
+	MaxTokens     *int           `json:"max_tokens,omitempty"`
+	Temperature   *float64       `json:"temperature,omitempty"`
+	TopP          *float64       `json:"top_p,omitempty"`
+	TopK          *int           `json:"top_k,omitempty"`
+	MinP          *float64       `json:"min_p,omitempty"`
+	RepeatPenalty *float64       `json:"repeat_penalty,omitempty"`
+	Seed          *int           `json:"seed,omitempty"`
+	Stop          []string       `json:"stop,omitempty"`
+}
+
+type localMessage struct {
+	Role             string          `json:"role"`
+	Content          string          `json:"content"`
+	ReasoningContent string          `json:"reasoning_content,omitempty"`
+	ToolCalls        []localToolCall `json:"tool_calls,omitempty"`
+	ToolCallID       string          `json:"tool_call_id,omitempty"`
+	// Images are data URLs. A message with images is sent with a list of
+	// content parts instead of a plain string.
+	Images []string `json:"-"`
+}
+
+type localContentPart struct {
+	Type     string         `json:"type"`
+	Text     string         `json:"text,omitempty"`
+	ImageURL *localImageURL `json:"image_url,omitempty"`
+}
+
+type localImageURL struct {
+	URL string `json:"url"`
+}
+
+func (m localMessage) MarshalJSON() ([]byte, error) {
+	type plain localMessage
+	if len(m.Images) == 0 {
+		return json.Marshal(plain(m))
+	}
+
+	parts := make([]localContentPart, 0, len(m.Images)+1)
+	if m.Content != "" {
+		parts = append(parts, localContentPart{Type: "text", Text: m.Content})
+	}
+	for _, url := range m.Images {
+		parts = append(parts, localContentPart{Type: "image_url", ImageURL: &localImageURL{URL: url}})
+	}
+	return json.Marshal(struct {
+		plain
+		Content []localContentPart `json:"content"`
+	}{plain: plain(m), Content: parts})
+}
+
+type localToolCall struct {
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type"`
+	Function localFunctionCall `json:"function"`
+}
+
+type localFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type localTool struct {
+	Type     string        `json:"type"`
+	Function localFunction `json:"function"`
+}
+
+type localFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
+type localResponse struct {
+	Choices []struct {
+		Message localMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
@@ -0,0 +1,219 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+type localTestRequest struct {
+	Messages []struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"messages"`
+	Tools       []json.RawMessage `json:"tools"`
+	Temperature *float64          `json:"temperature"`
+	TopK        *int              `json:"top_k"`
+	MaxTokens   int               `json:"max_tokens"`
+	CachePrompt bool              `json:"cache_prompt"`
+}
+
+// localServer records the requests and answers with the responses in order.
+func localServer(t *testing.T, responses ...string) (*httptest.Server, *[]localTestRequest) {
+	t.Helper()
+
+	requests := make([]localTestRequest, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req localTestRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("could not parse request: %v", err)
+		}
+		requests = append(requests, req)
+		if len(responses) == 0 {
+			t.Errorf("unexpected request")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp := responses[0]
+		responses = responses[1:]
+		if strings.HasPrefix(resp, "error:") {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(strings.TrimPrefix(resp, "error:")))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(resp))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func localAnswer(content string) string {
+	data, _ := json.Marshal(map[string]any{
+		"choices": []map[string]any{{"message": map[string]any{"role": "assistant", "content": content}}},
+	})
+	return string(data)
+}
+
+func TestLocalToolFallback(t *testing.T) {
+	srv, requests := localServer(t,
+		`error:{"error":{"code":500,"message":"tools param requires --jinja flag"}}`,
+		localAnswer("Let me look.\n<tool_call>\n{\"name\": \"read_file\", \"arguments\": {\"path\": \"a.txt\"}}\n</tool_call>"),
+		localAnswer("It is empty."),
+	)
+	provider := testProvider("local", srv.URL)
+	l, err := NewLLM(provider, contractModel, "Be nice.")
+	if err != nil {
+		t.Fatalf("could not create local: %v", err)
+	}
+	tools := []tool.Tool{tool.NewReadFile()}
+	conversation := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "what is in a.txt?"}}}}
+
+	msg, err := l.RunInference(context.Background(), tools, conversation)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(msg.Content) != 2 || msg.Content[0].Text != "Let me look." || msg.Content[1].ToolUse.Name != "read_file" {
+		t.Fatalf("expected text and tool call, got %+v", msg.Content)
+	}
+	if len(*requests) != 2 || len((*requests)[0].Tools) != 1 || len((*requests)[1].Tools) != 0 {
+		t.Fatalf("expected a request with tools and one without, got %+v", *requests)
+	}
+	if sys := (*requests)[1].Messages[0].Content; !strings.HasPrefix(sys, "Be nice.") || !strings.Contains(sys, "## read_file") {
+		t.Errorf("expected tools in system prompt, got %q", sys)
+	}
+
+	// the server does not support tools, so the next request does not try
+	conversation = append(conversation, msg, Message{Role: RoleUser, Content: []ContentBlock{{
+		Type:       ContentTypeToolResult,
+		ToolResult: ToolResult{ID: msg.Content[1].ToolUse.ID, Result: "nothing"},
+	}}})
+	if _, err := l.RunInference(context.Background(), tools, conversation); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	last := (*requests)[2]
+	if len(last.Tools) != 0 || len(last.Messages) != 4 {
+		t.Fatalf("expected prompt based request with 4 messages, got %+v", last)
+	}
+	if act := last.Messages[2].Content; !strings.Contains(act, `<tool_call>`) || !strings.Contains(act, `"name": "read_file"`) {
+		t.Errorf("expected tool call as text, got %q", act)
+	}
+	if act := last.Messages[3].Content; act != "<tool_result>\nnothing\n</tool_result>" {
+		t.Errorf("expected tool result as text, got %q", act)
+	}
+}
+
+func TestLocalToolArguments(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args string
+		exp  string
+	}{
+		{name: "valid", args: `{"path": "a.txt"}`, exp: `{"path": "a.txt"}`},
+		{name: "empty", args: "", exp: "{}"},
+		{name: "invalid", args: `{"path": "a.txt"`, exp: `"{\"path\": \"a.txt\""`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var resp localResponse
+			data, _ := json.Marshal(map[string]any{
+				"choices": []map[string]any{{"message": map[string]any{
+					"role": "assistant",
+					"tool_calls": []map[string]any{{
+						"id":       "call_1",
+						"type":     "function",
+						"function": map[string]any{"name": "read_file", "arguments": tc.args},
+					}},
+				}}},
+			})
+			if err := json.Unmarshal(data, &resp); err != nil {
+				t.Fatalf("could not parse response: %v", err)
+			}
+			l := &Local{}
+			msg, err := l.convertResponse(&resp)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			input := msg.Content[0].ToolUse.Input
+			if string(input) != tc.exp {
+				t.Errorf("expected input %s, got %s", tc.exp, input)
+			}
+			// the conversation must stay storable
+			if _, err := json.Marshal(msg); err != nil {
+				t.Errorf("could not marshal message: %v", err)
+			}
+		})
+	}
+}
+
+func TestLocalErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		exp  string
+	}{
+		{name: "openai style", body: `{"error":{"message":"model not loaded"}}`, exp: "model not loaded"},
+		{name: "string", body: `{"error":"model not loaded"}`, exp: "model not loaded"},
+		{name: "plain text", body: `model not loaded`, exp: "model not loaded"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := localServer(t, "error:"+tc.body)
+			l, err := NewLocal(testProvider("local", srv.URL), contractModel, "")
+			if err != nil {
+				t.Fatalf("could not create local: %v", err)
+			}
+			_, err = l.RunInference(context.Background(), nil, nil)
+			if err == nil || !strings.HasSuffix(err.Error(), ": "+tc.exp) {
+				t.Errorf("expected error with %q, got %v", tc.exp, err)
+			}
+		})
+	}
+}
+
+func TestLocalContextAndParams(t *testing.T) {
+	srv, requests := localServer(t, localAnswer("ok"))
+	temp, topK, maxTokens := 0.2, 40, 20
+	provider := testProvider("local", srv.URL)
+	provider.Models[0].ContextSize = 100
+	provider.Models[0].Params = Params{
+		Temperature: &temp,
+		TopK:        &topK,
+		MaxTokens:   &maxTokens,
+		Extra:       map[string]any{"cache_prompt": true},
+	}
+	l, err := NewLocal(provider, contractModel, "")
+	if err != nil {
+		t.Fatalf("could not create local: %v", err)
+	}
+
+	long := strings.Repeat("word ", 40)
+	conversation := []Message{
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "first " + long}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "answer " + long}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "second " + long}}},
+		{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "answer"}}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "last"}}},
+	}
+	if _, err := l.RunInference(context.Background(), nil, conversation); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := (*requests)[0]
+	roles := make([]string, 0)
+	for _, m := range req.Messages {
+		roles = append(roles, m.Role)
+	}
+	if strings.Join(roles, ",") != "system,user,assistant,user" || !strings.HasPrefix(req.Messages[1].Content, "second") {
+		t.Errorf("expected the oldest messages to be dropped, got %v", roles)
+	}
+	if req.Temperature == nil || *req.Temperature != temp || req.TopK == nil || *req.TopK != topK || req.MaxTokens != 20 || !req.CachePrompt {
+		t.Errorf("expected generation parameters, got %+v", req)
+	}
+}
@@ -0,0 +1,335 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const openAIBaseURL = "https://api.openai.com/v1"
+
+var (
+	ErrListNotSupported = errors.New("provider can not list its models")
+	ErrModelNotFound    = errors.New("model is not offered by the provider")
+)
+
+// Capabilities that providers report for their models.
+const (
+	CapabilityTools  = "tools"
+	CapabilityVision = "vision"
+)
+
+// RemoteModel is a model that a provider offers.
+type RemoteModel struct {
+	Name string
+	// ContextSize is zero when the provider does not tell.
+	ContextSize int
+	// Capabilities are features of the model, like tools. Nil means that the
+	// provider does not tell.
+	Capabilities []string
+}
+
+// Supports tells whether the model has the capability, and whether that is
+// known at all.
+func (m RemoteModel) Supports(capability string) (bool, bool) {
+	if m.Capabilities == nil {
+		return false, false
+	}
+
+	return slices.Contains(m.Capabilities, capability), true
+}
+
+// ListModels asks the provider which models it offers. It returns
+// ErrListNotSupported for providers that have no way to do so.
+func ListModels(ctx context.Context, provider Provider) ([]RemoteModel, error) {
+	provider, err := provider.withKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var models []RemoteModel
+	switch provider.Type {
+	case "claude":
+		models, err = listClaudeModels(ctx, provider)
+	case "openai", "local":
+		models, err = listOpenAIModels(ctx, provider)
+	case "ollama":
+		models, err = listOllamaModels(ctx, provider)
+	case "gemini":
+		models, err = listGeminiModels(ctx, provider)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrListNotSupported, provider.Type)
+	}
+	if err != nil {
+		return nil, redactError(err)
+	}
+	slices.SortFunc(models, func(a, b RemoteModel) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return models, nil
+}
+
+// FindModel asks the provider about one model. Unlike ListModels, it also
+// finds models by an alias, like claude-3-7-sonnet-latest, or by an Ollama
+// name without tag. The name of the result is the one the provider uses. It
+// returns ErrModelNotFound when the provider does not offer the model.
+func FindModel(ctx context.Context, provider Provider, name string) (RemoteModel, error) {
+	provider, err := provider.withKey()
+	if err != nil {
+		return RemoteModel{}, err
+	}
+
+	var model RemoteModel
+	switch provider.Type {
+	case "claude":
+		model, err = getClaudeModel(ctx, provider, name)
+	case "openai", "local":
+		// not every compatible server, like OpenRouter, can get one model
+		model, err = findOpenAIModel(ctx, provider, name)
+	case "ollama":
+		model, err = showOllamaModel(ctx, provider, ollamaName(name))
+	case "gemini":
+		model, err = getGeminiModel(ctx, provider, name)
+	default:
+		return RemoteModel{}, fmt.Errorf("%w: %s", ErrListNotSupported, provider.Type)
+	}
+	var apiErr *APIError
+	var antErr *anthropic.Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound || errors.As(err, &antErr) && antErr.StatusCode == http.StatusNotFound {
+		return RemoteModel{}, fmt.Errorf("%w: %s", ErrModelNotFound, name)
+	}
+	if err != nil {
+		return RemoteModel{}, redactError(err)
+	}
+
+	return model, nil
+}
+
+// ollamaName adds the tag that Ollama assumes when there is none.
+func ollamaName(name string) string {
+	if strings.Contains(path.Base(name), ":") {
+		return name
+	}
+
+	return name + ":latest"
+}
+
+// claudeCapabilities are the same for every claude model.
+var claudeCapabilities = []string{CapabilityTools, CapabilityVision}
+
+func getClaudeModel(ctx context.Context, provider Provider, name string) (RemoteModel, error) {
+	c := anthropic.NewClient(claudeOptions(provider)...)
+	m, err := c.Models.Get(ctx, name, anthropic.ModelGetParams{})
+	if err != nil {
+		return RemoteModel{}, err
+	}
+
+	return RemoteModel{Name: m.ID, Capabilities: claudeCapabilities}, nil
+}
+
+func listClaudeModels(ctx context.Context, provider Provider) ([]RemoteModel, error) {
+	c := anthropic.NewClient(claudeOptions(provider)...)
+	pager := c.Models.ListAutoPaging(ctx, anthropic.ModelListParams{})
+	models := make([]RemoteModel, 0)
+	for pager.Next() {
+		m := pager.Current()
+		models = append(models, RemoteModel{Name: m.ID, Capabilities: claudeCapabilities})
+	}
+	if err := pager.Err(); err != nil {
+		return nil, err
+	}
+
+	return models, nil
+}
+
+// listOpenAIModels reads the /models endpoint. Some servers, like
+// OpenRouter, add the context size and the supported parameters.
+func listOpenAIModels(ctx context.Context, provider Provider) ([]RemoteModel, error) {
+	baseURL := provider.BaseURL
+	if baseURL == "" {
+		baseURL = openAIBaseURL
+	}
+	header := http.Header{}
+	if provider.ApiKey != "" {
+		header.Set("Authorization", "Bearer "+provider.ApiKey)
+	}
+	var resp struct {
+		Data []struct {
+			ID                  string   `json:"id"`
+			ContextLength       int      `json:"context_length"`
+			SupportedParameters []string `json:"supported_parameters"`
+		} `json:"data"`
+	}
+	if err := requestJSON(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/models", header, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	models := make([]RemoteModel, 0, len(resp.Data))
+	for _, d := range resp.Data {
+		m := RemoteModel{Name: d.ID, ContextSize: d.ContextLength}
+		if d.SupportedParameters != nil {
+			m.Capabilities = make([]string, 0)
+			if slices.Contains(d.SupportedParameters, "tools") {
+				m.Capabilities = append(m.Capabilities, CapabilityTools)
+			}
+		}
+		models = append(models, m)
+	}
+
+	return models, nil
+}
+
+func findOpenAIModel(ctx context.Context, provider Provider, name string) (RemoteModel, error) {
+	models, err := listOpenAIModels(ctx, provider)
+	if err != nil {
+		return RemoteModel{}, err
+	}
+	for _, m := range models {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+
+	return RemoteModel{}, fmt.Errorf("%w: %s", ErrModelNotFound, name)
+}
+
+// listOllamaModels reads the installed models from /api/tags, and the
+// details of each from /api/show.
+func listOllamaModels(ctx context.Context, provider Provider) ([]RemoteModel, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := requestJSON(ctx, http.MethodGet, provider.BaseURL+"/api/tags", nil, nil, &tags); err != nil {
+		return nil, err
+	}
+
+	models := make([]RemoteModel, 0, len(tags.Models))
+	for _, t := range tags.Models {
+		m, err := showOllamaModel(ctx, provider, t.Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not show model %s: %w", t.Name, err)
+		}
+		models = append(models, m)
+	}
+
+	return models, nil
+}
+
+func showOllamaModel(ctx context.Context, provider Provider, name string) (RemoteModel, error) {
+	var show struct {
+		ModelInfo    map[string]any `json:"model_info"`
+		Capabilities []string       `json:"capabilities"`
+	}
+	if err := requestJSON(ctx, http.MethodPost, provider.BaseURL+"/api/show", nil, map[string]string{"model": name}, &show); err != nil {
+		return RemoteModel{}, err
+	}
+	m := RemoteModel{Name: name, Capabilities: show.Capabilities}
+	// the key starts with the architecture, like qwen3.context_length
+	for k, v := range show.ModelInfo {
+		if size, ok := v.(float64); ok && strings.HasSuffix(k, ".context_length") {
+			m.ContextSize = int(size)
+		}
+	}
+
+	return m, nil
+}
+
+type geminiModel struct {
+	Name                       string   `json:"name"`
+	InputTokenLimit            int      `json:"inputTokenLimit"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+func (m geminiModel) remote() RemoteModel {
+	return RemoteModel{
+		Name:        strings.TrimPrefix(m.Name, "models/"),
+		ContextSize: m.InputTokenLimit,
+	}
+}
+
+func geminiModelsRequest(provider Provider) (string, http.Header) {
+	baseURL := provider.BaseURL
+	if baseURL == "" {
+		baseURL = geminiBaseURL
+	}
+	header := http.Header{}
+	header.Set("x-goog-api-key", provider.ApiKey)
+
+	return strings.TrimSuffix(baseURL, "/"), header
+}
+
+func listGeminiModels(ctx context.Context, provider Provider) ([]RemoteModel, error) {
+	baseURL, header := geminiModelsRequest(provider)
+	var resp struct {
+		Models []geminiModel `json:"models"`
+	}
+	if err := requestJSON(ctx, http.MethodGet, baseURL+"/models?pageSize=1000", header, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	models := make([]RemoteModel, 0, len(resp.Models))
+	for _, m := range resp.Models {
+		if !slices.Contains(m.SupportedGenerationMethods, "generateContent") {
+			continue
+		}
+		models = append(models, m.remote())
+	}
+
+	return models, nil
+}
+
+func getGeminiModel(ctx context.Context, provider Provider, name string) (RemoteModel, error) {
+	baseURL, header := geminiModelsRequest(provider)
+	var m geminiModel
+	if err := requestJSON(ctx, http.MethodGet, baseURL+"/models/"+strings.TrimPrefix(name, "models/"), header, nil, &m); err != nil {
+		return RemoteModel{}, err
+	}
+
+	return m.remote(), nil
+}
+
+// requestJSON sends body, if it is not nil, as JSON and decodes the response
+// into v.
+func requestJSON(ctx context.Context, method, url string, header http.Header, body, v any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, &reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newAPIError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
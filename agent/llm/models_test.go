@@ -0,0 +1,227 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestListModels(t *testing.T) {
+	for _, tc := range []struct {
+		provider string
+		path     string
+		handler  http.HandlerFunc
+		exp      []RemoteModel
+	}{
+		{
+			provider: "claude",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/models" {
+					http.NotFound(w, r)
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{
+					"data": []map[string]any{
+						{"id": "claude-b", "type": "model", "display_name": "B", "created_at": "2025-01-01T00:00:00Z"},
+						{"id": "claude-a", "type": "model", "display_name": "A", "created_at": "2025-01-01T00:00:00Z"},
+					},
+					"has_more": false,
+				})
+			},
+			exp: []RemoteModel{
+				{Name: "claude-a", Capabilities: []string{CapabilityTools, CapabilityVision}},
+				{Name: "claude-b", Capabilities: []string{CapabilityTools, CapabilityVision}},
+			},
+		},
+		{
+			provider: "openai",
+			path:     "/v1",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/models" || r.Header.Get("Authorization") != "Bearer test-key" {
+					http.NotFound(w, r)
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"data": []map[string]any{
+					{"id": "plain"},
+					{"id": "router", "context_length": 200000, "supported_parameters": []string{"tools", "seed"}},
+				}})
+			},
+			exp: []RemoteModel{
+				{Name: "plain"},
+				{Name: "router", ContextSize: 200000, Capabilities: []string{CapabilityTools}},
+			},
+		},
+		{
+			provider: "ollama",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/tags":
+					writeJSON(w, http.StatusOK, map[string]any{"models": []map[string]any{{"name": "qwen3:32b"}}})
+				case "/api/show":
+					var req struct {
+						Model string `json:"model"`
+					}
+					json.NewDecoder(r.Body).Decode(&req)
+					if req.Model != "qwen3:32b" {
+						writeJSON(w, http.StatusNotFound, map[string]any{"error": "model not found"})
+						return
+					}
+					writeJSON(w, http.StatusOK, map[string]any{
+						"model_info":   map[string]any{"general.architecture": "qwen3", "qwen3.context_length": 40960},
+						"capabilities": []string{"completion", "tools", "thinking"},
+					})
+				default:
+					http.NotFound(w, r)
+				}
+			},
+			exp: []RemoteModel{
+				{Name: "qwen3:32b", ContextSize: 40960, Capabilities: []string{"completion", "tools", "thinking"}},
+			},
+		},
+		{
+			provider: "gemini",
+			path:     "/v1beta",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1beta/models" || r.Header.Get("x-goog-api-key") != "test-key" {
+					http.NotFound(w, r)
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"models": []map[string]any{
+					{"name": "models/gemini-2.5-pro", "inputTokenLimit": 1048576, "supportedGenerationMethods": []string{"generateContent"}},
+					{"name": "models/embedding-001", "supportedGenerationMethods": []string{"embedContent"}},
+				}})
+			},
+			exp: []RemoteModel{
+				{Name: "gemini-2.5-pro", ContextSize: 1048576},
+			},
+		},
+	} {
+		t.Run(tc.provider, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				tc.handler(w, r)
+			}))
+			defer srv.Close()
+
+			act, err := ListModels(context.Background(), testProvider(tc.provider, srv.URL+tc.path))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(act, tc.exp) {
+				t.Errorf("expected %+v, got %+v", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestListModelsErrors(t *testing.T) {
+	if _, err := ListModels(context.Background(), testProvider("replay", "")); !errors.Is(err, ErrListNotSupported) {
+		t.Errorf("expected ErrListNotSupported, got %v", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"error": map[string]any{"message": "invalid key"}})
+	}))
+	defer srv.Close()
+	_, err := ListModels(context.Background(), testProvider("openai", srv.URL))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized || apiErr.Message != "invalid key" {
+		t.Errorf("expected an API error for the key, got %v", err)
+	}
+}
+
+func TestFindModel(t *testing.T) {
+	for _, tc := range []struct {
+		provider string
+		path     string
+		name     string
+		handler  http.HandlerFunc
+		exp      RemoteModel
+		expErr   error
+	}{
+		{
+			provider: "claude",
+			name:     "claude-3-7-sonnet-latest",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/models/claude-3-7-sonnet-latest" {
+					writeJSON(w, http.StatusNotFound, map[string]any{"type": "error", "error": map[string]any{"type": "not_found_error", "message": "model not found"}})
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"id": "claude-3-7-sonnet-20250219", "type": "model", "display_name": "Claude 3.7 Sonnet", "created_at": "2025-02-19T00:00:00Z"})
+			},
+			exp: RemoteModel{Name: "claude-3-7-sonnet-20250219", Capabilities: []string{CapabilityTools, CapabilityVision}},
+		},
+		{
+			provider: "claude",
+			name:     "claude-none",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusNotFound, map[string]any{"type": "error", "error": map[string]any{"type": "not_found_error", "message": "model not found"}})
+			},
+			expErr: ErrModelNotFound,
+		},
+		{
+			provider: "openai",
+			path:     "/v1",
+			name:     "gpt-y",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, map[string]any{"data": []map[string]any{{"id": "gpt-x"}}})
+			},
+			expErr: ErrModelNotFound,
+		},
+		{
+			provider: "ollama",
+			name:     "qwen3",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Model string `json:"model"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				if r.URL.Path != "/api/show" || req.Model != "qwen3:latest" {
+					writeJSON(w, http.StatusNotFound, map[string]any{"error": "model not found"})
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"capabilities": []string{"completion", "tools"}})
+			},
+			exp: RemoteModel{Name: "qwen3:latest", Capabilities: []string{"completion", "tools"}},
+		},
+		{
+			provider: "gemini",
+			path:     "/v1beta",
+			name:     "gemini-flash-latest",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1beta/models/gemini-flash-latest" {
+					writeJSON(w, http.StatusNotFound, map[string]any{"error": map[string]any{"message": "not found"}})
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"name": "models/gemini-flash-latest", "inputTokenLimit": 1048576})
+			},
+			exp: RemoteModel{Name: "gemini-flash-latest", ContextSize: 1048576},
+		},
+	} {
+		t.Run(tc.provider+" "+tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				tc.handler(w, r)
+			}))
+			defer srv.Close()
+
+			act, err := FindModel(context.Background(), testProvider(tc.provider, srv.URL+tc.path), tc.name)
+			if tc.expErr != nil {
+				if !errors.Is(err, tc.expErr) {
+					t.Errorf("expected %v, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(act, tc.exp) {
+				t.Errorf("expected %+v, got %+v", tc.exp, act)
+			}
+		})
+	}
+}
@@ -3,10 +3,12 @@ package llm
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"reflect"
+	"regexp"
 	"strings"
 
 	"go-mod.ewintr.nl/henk/agent/tool"
@@ -18,6 +20,7 @@ type Ollama struct {
 	modelShortName string
 	systemPrompt   string
 	contextSize    int
+	params         Params
 	client         *http.Client
 }
 
@@ -33,6 +36,7 @@ func NewOllama(provider Provider, modelName, systemPrompt string) (*Ollama, erro
 		modelShortName: m.ShortName,
 		systemPrompt:   systemPrompt,
 		contextSize:    m.ContextSize,
+		params:         m.Params,
 		client:         &http.Client{},
 	}, nil
 }
@@ -49,36 +53,71 @@ func (o *Ollama) RunInference(ctx context.Context, tools []tool.Tool, conversati
 		Content: o.systemPrompt,
 	})
 
+	// Ollama does not use ids for tool calls, results are linked to the call
+	// by the name of the tool and their order
+	toolNames := make(map[string]string)
 	for _, msg := range conversation {
-		if msg.Role == RoleUser || msg.Role == RoleAssistant {
-			// Convert content blocks to appropriate format
-			var content strings.Builder
-			var toolResults []string
-
-			for _, block := range msg.Content {
-				switch block.Type {
-				case ContentTypeText:
-					content.WriteString(block.Text)
-				case ContentTypeToolResult:
-					toolResults = append(toolResults, fmt.Sprintf("Tool %s result: %s", block.ToolResult.ID, block.ToolResult.Result))
-				}
-			}
+		if msg.Role != RoleUser && msg.Role != RoleAssistant {
+			return Message{}, fmt.Errorf("unknown message role: %s", msg.Role)
+		}
 
-			// Add tool results to content if any
-			if len(toolResults) > 0 {
-				if content.Len() > 0 {
-					content.WriteString("\n")
+		var content strings.Builder
+		var images []string
+		var toolCalls []ollamaToolCall
+		var toolResults []ollamaMessage
+		var resultImages []string
+		for _, block := range msg.Content {
+			switch block.Type {
+			case ContentTypeText:
+				content.WriteString(block.Text)
+			case ContentTypeToolUse:
+				tu := block.ToolUse
+				toolNames[tu.ID] = tu.Name
+				args := tu.Input
+				if len(args) == 0 {
+					args = json.RawMessage("{}")
 				}
-				content.WriteString(strings.Join(toolResults, "\n"))
-			}
-
-			if content.Len() > 0 {
-				ollamaMessages = append(ollamaMessages, ollamaMessage{
-					Role:    string(msg.Role),
-					Content: content.String(),
+				toolCalls = append(toolCalls, ollamaToolCall{
+					Function: ollamaToolCallFunction{
+						Name:      tu.Name,
+						Arguments: args,
+					},
+				})
+			case ContentTypeToolResult:
+				toolResults = append(toolResults, ollamaMessage{
+					Role:     "tool",
+					Content:  toolResultContent(block.ToolResult),
+					ToolName: toolNames[block.ToolResult.ID],
 				})
+				for _, img := range block.ToolResult.Images {
+					resultImages = append(resultImages, img.Base64())
+				}
+			case ContentTypeImage:
+				images = append(images, block.Image.Base64())
+			case ContentTypeThinking:
+				// reasoning is not sent back to the model
+			default:
+				return Message{}, fmt.Errorf("unknown message content type: %s", block.Type)
 			}
 		}
+
+		if content.Len() > 0 || len(images) > 0 || len(toolCalls) > 0 {
+			ollamaMessages = append(ollamaMessages, ollamaMessage{
+				Role:      string(msg.Role),
+				Content:   content.String(),
+				Images:    images,
+				ToolCalls: toolCalls,
+			})
+		}
+		ollamaMessages = append(ollamaMessages, toolResults...)
+		// a tool message can only hold text, images follow as a message of
+		// the user
+		if len(resultImages) > 0 {
+			ollamaMessages = append(ollamaMessages, ollamaMessage{
+				Role:   string(RoleUser),
+				Images: resultImages,
+			})
+		}
 	}
 
 	// Convert tools to Ollama format
@@ -110,9 +149,15 @@ func (o *Ollama) RunInference(ctx context.Context, tools []tool.Tool, conversati
 		Model:    o.modelName,
 		Messages: ollamaMessages,
 		Tools:    ollamaTools,
-		Options: ollamaChatRequestOptions{
-			NumCtx: o.contextSize,
-		},
+		Options:  o.options(),
+	}
+	if keepAlive, ok := o.params.Extra["keep_alive"]; ok {
+		request.KeepAlive = keepAlive
+	}
+	// ollama has no budget for thinking, it can only be turned on or off
+	if budget := o.params.ThinkingBudget; budget != nil {
+		think := *budget > 0
+		request.Think = &think
 	}
 
 	// Make HTTP request
@@ -125,6 +170,39 @@ func (o *Ollama) RunInference(ctx context.Context, tools []tool.Tool, conversati
 	return o.convertResponse(resp, tools)
 }
 
+// options translates the parameters to the options of Ollama. Extra
+// parameters are options too, except for keep_alive.
+func (o *Ollama) options() map[string]any {
+	options := make(map[string]any)
+	if o.contextSize > 0 {
+		options["num_ctx"] = o.contextSize
+	}
+	p := o.params
+	for name, v := range map[string]any{
+		"num_predict":    p.MaxTokens,
+		"temperature":    p.Temperature,
+		"top_p":          p.TopP,
+		"top_k":          p.TopK,
+		"min_p":          p.MinP,
+		"repeat_penalty": p.RepeatPenalty,
+		"seed":           p.Seed,
+	} {
+		if !reflect.ValueOf(v).IsNil() {
+			options[name] = v
+		}
+	}
+	if p.Stop != nil {
+		options["stop"] = p.Stop
+	}
+	for k, v := range p.Extra {
+		if k != "keep_alive" {
+			options[k] = v
+		}
+	}
+
+	return options
+}
+
 func (o *Ollama) makeRequest(ctx context.Context, request ollamaChatRequest) (*ollamaChatResponse, error) {
 	jsonData, err := json.Marshal(request)
 	if err != nil {
@@ -146,8 +224,7 @@ func (o *Ollama) makeRequest(ctx context.Context, request ollamaChatRequest) (*o
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, newAPIError(resp)
 	}
 
 	var response ollamaChatResponse
@@ -162,20 +239,42 @@ func (o *Ollama) convertResponse(resp *ollamaChatResponse, tools []tool.Tool) (M
 	message := Message{
 		Role:    RoleAssistant,
 		Content: make([]ContentBlock, 0),
+		Usage: Usage{
+			InputTokens:  resp.PromptEvalCount,
+			OutputTokens: resp.EvalCount,
+		},
+	}
+
+	// without think in the request, reasoning models write their thinking
+	// in the text
+	thinking, text := splitThinking(resp.Message.Content)
+	message.Content = appendThinking(message.Content, resp.Message.Thinking, thinking)
+
+	toolCalls := resp.Message.ToolCalls
+	// some models write tool calls in the text instead of using the api
+	if len(toolCalls) == 0 {
+		text, toolCalls = parseTextToolCalls(text)
 	}
 
 	// Add text content if present
-	if resp.Message.Content != "" {
+	if strings.TrimSpace(text) != "" {
 		message.Content = append(message.Content, ContentBlock{
 			Type: ContentTypeText,
-			Text: resp.Message.Content,
+			Text: text,
 		})
 	}
 
 	// Handle tool calls
-	for i, toolCall := range resp.Message.ToolCalls {
+	for _, toolCall := range toolCalls {
+		id := toolCall.ID
+		if id == "" {
+			var err error
+			if id, err = newToolCallID(); err != nil {
+				return Message{}, err
+			}
+		}
 		toolUse := ToolUse{
-			ID:    fmt.Sprintf("tool_call_%d", i),
+			ID:    id,
 			Name:  toolCall.Function.Name,
 			Input: toolCall.Function.Arguments,
 		}
@@ -189,9 +288,66 @@ func (o *Ollama) convertResponse(resp *ollamaChatResponse, tools []tool.Tool) (M
 	return message, nil
 }
 
+var textToolCallRE = regexp.MustCompile(`(?s)<tool_call>\s*(.*?)\s*</tool_call>`)
+
+// parseTextToolCalls finds tool calls that are written in the text as JSON
+// between <tool_call> tags. It returns the text without the calls.
+func parseTextToolCalls(text string) (string, []ollamaToolCall) {
+	var calls []ollamaToolCall
+	rest := textToolCallRE.ReplaceAllStringFunc(text, func(match string) string {
+		var call struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		body := textToolCallRE.FindStringSubmatch(match)[1]
+		if err := json.Unmarshal([]byte(body), &call); err != nil || call.Name == "" {
+			return match
+		}
+		// arguments are sometimes encoded as a string. When that string is not
+		// JSON, the call stays text, an invalid input could not be stored or
+		// sent back.
+		var s string
+		if err := json.Unmarshal(call.Arguments, &s); err == nil {
+			if s != "" && !json.Valid([]byte(s)) {
+				return match
+			}
+			call.Arguments = json.RawMessage(s)
+		}
+		if len(call.Arguments) == 0 {
+			call.Arguments = json.RawMessage("{}")
+		}
+		calls = append(calls, ollamaToolCall{
+			Function: ollamaToolCallFunction{
+				Name:      call.Name,
+				Arguments: call.Arguments,
+			},
+		})
+		return ""
+	})
+	if len(calls) == 0 {
+		return text, nil
+	}
+
+	return strings.TrimSpace(rest), calls
+}
+
+// newToolCallID creates a random id, so that ids of tool calls do not
+// collide across responses.
+func newToolCallID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not create tool call id: %w", err)
+	}
+
+	return fmt.Sprintf("call_%x", b), nil
+}
+
 type ollamaMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
 }
 
 type ollamaTool struct {
@@ -206,6 +362,7 @@ type ollamaToolFunction struct {
 }
 
 type ollamaToolCall struct {
+	ID       string                 `json:"id,omitempty"`
 	Function ollamaToolCallFunction `json:"function"`
 }
 
@@ -214,26 +371,27 @@ type ollamaToolCallFunction struct {
 	Arguments json.RawMessage `json:"arguments"`
 }
 
-type ollamaChatRequestOptions struct {
-	NumCtx int `json:"num_ctx,omitempty"`
-}
-
 type ollamaChatRequest struct {
-	Model    string                   `json:"model"`
-	Messages []ollamaMessage          `json:"messages"`
-	Tools    []ollamaTool             `json:"tools,omitempty"`
-	Stream   bool                     `json:"stream"`
-	Options  ollamaChatRequestOptions `json:"options,omitempty"`
+	Model     string          `json:"model"`
+	Messages  []ollamaMessage `json:"messages"`
+	Tools     []ollamaTool    `json:"tools,omitempty"`
+	Stream    bool            `json:"stream"`
+	Options   map[string]any  `json:"options,omitempty"`
+	KeepAlive any             `json:"keep_alive,omitempty"`
+	Think     *bool           `json:"think,omitempty"`
 }
 
 type ollamaChatResponse struct {
-	Message    ollamaResponseMessage `json:"message"`
-	Done       bool                  `json:"done"`
-	DoneReason string                `json:"done_reason,omitempty"`
+	Message         ollamaResponseMessage `json:"message"`
+	Done            bool                  `json:"done"`
+	DoneReason      string                `json:"done_reason,omitempty"`
+	PromptEvalCount int                   `json:"prompt_eval_count,omitempty"`
+	EvalCount       int                   `json:"eval_count,omitempty"`
 }
 
 type ollamaResponseMessage struct {
 	Role      string           `json:"role"`
 	Content   string           `json:"content"`
+	Thinking  string           `json:"thinking,omitempty"`
 	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
 }
@@ -0,0 +1,78 @@
+package llm
+
+import (
+	"testing"
+)
+
+func TestOllamaToolCallsInText(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expText  string
+		expCalls []string
+	}{
+		{
+			name:    "no calls",
+			content: "just an answer",
+			expText: "just an answer",
+		},
+		{
+			name:     "object arguments",
+			content:  "Let me check.\n<tool_call>\n{\"name\": \"read_file\", \"arguments\": {\"path\": \"a.txt\"}}\n</tool_call>",
+			expText:  "Let me check.",
+			expCalls: []string{`read_file {"path": "a.txt"}`},
+		},
+		{
+			name:     "string arguments",
+			content:  `<tool_call>{"name": "read_file", "arguments": "{\"path\": \"a.txt\"}"}</tool_call><tool_call>{"name": "list_files", "arguments": {}}</tool_call>`,
+			expCalls: []string{`read_file {"path": "a.txt"}`, `list_files {}`},
+		},
+		{
+			name:    "invalid string arguments",
+			content: `<tool_call>{"name": "read_file", "arguments": "{path: a.txt"}</tool_call>`,
+			expText: `<tool_call>{"name": "read_file", "arguments": "{path: a.txt"}</tool_call>`,
+		},
+		{
+			name:    "invalid json",
+			content: "<tool_call>not json</tool_call>",
+			expText: "<tool_call>not json</tool_call>",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := &Ollama{}
+			msg, err := o.convertResponse(&ollamaChatResponse{
+				Message: ollamaResponseMessage{Role: "assistant", Content: tc.content},
+			}, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var text string
+			calls := make([]string, 0)
+			ids := make(map[string]bool)
+			for _, b := range msg.Content {
+				switch b.Type {
+				case ContentTypeText:
+					text = b.Text
+				case ContentTypeToolUse:
+					calls = append(calls, b.ToolUse.Name+" "+string(b.ToolUse.Input))
+					if b.ToolUse.ID == "" || ids[b.ToolUse.ID] {
+						t.Errorf("expected unique tool call id, got %q", b.ToolUse.ID)
+					}
+					ids[b.ToolUse.ID] = true
+				}
+			}
+			if text != tc.expText {
+				t.Errorf("expected text %q, got %q", tc.expText, text)
+			}
+			if len(calls) != len(tc.expCalls) {
+				t.Fatalf("expected calls %v, got %v", tc.expCalls, calls)
+			}
+			for i := range calls {
+				if calls[i] != tc.expCalls[i] {
+					t.Errorf("expected call %q, got %q", tc.expCalls[i], calls[i])
+				}
+			}
+		})
+	}
+}
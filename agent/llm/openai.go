@@ -1,8 +1,16 @@
 package llm
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"go-mod.ewintr.nl/henk/agent/tool"
@@ -14,6 +22,7 @@ type OpenAI struct {
 	modelName      string
 	modelShortName string
 	systemPrompt   string
+	params         Params
 }
 
 func NewOpenAI(provider Provider, modelName, systemPrompt string) (*OpenAI, error) {
@@ -24,6 +33,7 @@ func NewOpenAI(provider Provider, modelName, systemPrompt string) (*OpenAI, erro
 
 	config := openai.DefaultConfig(provider.ApiKey)
 	config.BaseURL = provider.BaseURL
+	config.HTTPClient = &http.Client{Transport: &openAITransport{fields: openAIFields(m.Params)}}
 	c := openai.NewClientWithConfig(config)
 	return &OpenAI{
 		client:         c,
@@ -31,6 +41,7 @@ func NewOpenAI(provider Provider, modelName, systemPrompt string) (*OpenAI, erro
 		modelName:      m.Name,
 		modelShortName: m.ShortName,
 		systemPrompt:   systemPrompt,
+		params:         m.Params,
 	}, nil
 }
 
@@ -45,49 +56,82 @@ func (o *OpenAI) RunInference(ctx context.Context, tools []tool.Tool, conversati
 		Content: o.systemPrompt,
 	})
 	for _, msg := range conversation {
+		role := ""
+		switch msg.Role {
+		case RoleAssistant:
+			role = openai.ChatMessageRoleAssistant
+		case RoleUser:
+			role = openai.ChatMessageRoleUser
+		default:
+			return Message{}, fmt.Errorf("unknown message role: %s", msg.Role)
+		}
+
+		// text and tool calls of a message go in one message, tool results
+		// each get their own message with the tool role
+		var text strings.Builder
+		var images []openai.ChatMessagePart
+		var toolCalls []openai.ToolCall
+		var toolResults []openai.ChatCompletionMessage
 		for _, block := range msg.Content {
-			var openaiMsg openai.ChatCompletionMessage
 			switch block.Type {
 			case ContentTypeText:
-				role := ""
-				switch msg.Role {
-				case RoleAssistant:
-					role = openai.ChatMessageRoleAssistant
-				case RoleUser:
-					role = openai.ChatMessageRoleUser
-				default:
-					return Message{}, fmt.Errorf("unknown message role: %s", msg.Role)
-				}
-				openaiMsg = openai.ChatCompletionMessage{
-					Role:    role,
-					Content: block.Text,
-				}
+				text.WriteString(block.Text)
 			case ContentTypeToolUse:
 				tu := block.ToolUse
-				openaiMsg = openai.ChatCompletionMessage{
-					Role: openai.ChatMessageRoleAssistant,
-					ToolCalls: []openai.ToolCall{
-						{
-							ID:   tu.ID,
-							Type: openai.ToolTypeFunction,
-							Function: openai.FunctionCall{
-								Name:      tu.Name,
-								Arguments: string(tu.Input),
-							},
-						},
+				toolCalls = append(toolCalls, openai.ToolCall{
+					ID:   tu.ID,
+					Type: openai.ToolTypeFunction,
+					Function: openai.FunctionCall{
+						Name:      tu.Name,
+						Arguments: string(tu.Input),
 					},
-				}
+				})
 			case ContentTypeToolResult:
 				tr := block.ToolResult
-				openaiMsg = openai.ChatCompletionMessage{
+				toolResults = append(toolResults, openai.ChatCompletionMessage{
 					Role:       openai.ChatMessageRoleTool,
-					Content:    tr.Result,
+					Content:    toolResultContent(tr),
 					ToolCallID: tr.ID,
+				})
+				// a tool message can only hold text, images follow in the
+				// message of the user
+				for _, img := range tr.Images {
+					images = append(images, openai.ChatMessagePart{
+						Type:     openai.ChatMessagePartTypeImageURL,
+						ImageURL: &openai.ChatMessageImageURL{URL: img.DataURL()},
+					})
 				}
+			case ContentTypeImage:
+				images = append(images, openai.ChatMessagePart{
+					Type:     openai.ChatMessagePartTypeImageURL,
+					ImageURL: &openai.ChatMessageImageURL{URL: block.Image.DataURL()},
+				})
+			case ContentTypeThinking:
+				// reasoning is not sent back to the model
 			default:
 				return Message{}, fmt.Errorf("unknown message content type: %s", block.Type)
 			}
-			openaiConv = append(openaiConv, openaiMsg)
+		}
+
+		openaiConv = append(openaiConv, toolResults...)
+		switch {
+		case len(images) > 0:
+			// a message with images is a list of parts
+			parts := images
+			if text.Len() > 0 {
+				parts = append([]openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: text.String()}}, images...)
+			}
+			openaiConv = append(openaiConv, openai.ChatCompletionMessage{
+				Role:         role,
+				MultiContent: parts,
+				ToolCalls:    toolCalls,
+			})
+		case text.Len() > 0 || len(toolCalls) > 0:
+			openaiConv = append(openaiConv, openai.ChatCompletionMessage{
+				Role:      role,
+				Content:   text.String(),
+				ToolCalls: toolCalls,
+			})
 		}
 	}
 
@@ -103,27 +147,46 @@ func (o *OpenAI) RunInference(ctx context.Context, tools []tool.Tool, conversati
 		})
 	}
 
+	// the sampling parameters and the extras are added by openAITransport
 	req := openai.ChatCompletionRequest{
 		Model:    o.modelName,
 		Messages: openaiConv,
 		Tools:    openaiTools,
+		Seed:     o.params.Seed,
+		Stop:     o.params.Stop,
+	}
+	if o.params.MaxTokens != nil {
+		req.MaxTokens = *o.params.MaxTokens
 	}
 
-	resp, err := o.client.CreateChatCompletion(ctx, req)
+	var wait time.Duration
+	resp, err := o.client.CreateChatCompletion(context.WithValue(ctx, retryAfterKey{}, &wait), req)
 	if err != nil {
-		return Message{}, fmt.Errorf("ChatCompletion error: %v", err)
+		return Message{}, fmt.Errorf("ChatCompletion error: %w", withWait(err, wait))
 	}
 
+	// content filters and some errors of OpenRouter give no choices
+	if len(resp.Choices) == 0 {
+		return Message{}, fmt.Errorf("response has no choices")
+	}
 	message := Message{
 		Role:    RoleAssistant,
 		Content: []ContentBlock{},
+		Usage: Usage{
+			InputTokens:  resp.Usage.PromptTokens,
+			OutputTokens: resp.Usage.CompletionTokens,
+		},
 	}
 
+	// reasoning comes in a separate field, like with DeepSeek, or in the
+	// text between <think> tags
 	choice := resp.Choices[0]
-	if choice.Message.Content != "" {
+	thinking, text := splitThinking(choice.Message.Content)
+	message.Content = appendThinking(message.Content, choice.Message.ReasoningContent, thinking)
+	if text != "" {
 		message.Content = append(message.Content, ContentBlock{
 			Type: ContentTypeText,
-			Text: choice.Message.Content,
+			Text: text,
 		})
 	}
 
@@ -134,7 +197,7 @@ func (o *OpenAI) RunInference(ctx context.Context, tools []tool.Tool, conversati
 				ToolUse: ToolUse{
 					ID:    toolCall.ID,
 					Name:  toolCall.Function.Name,
-					Input: []byte(toolCall.Function.Arguments),
+					Input: toolInput(toolCall.Function.Arguments),
 				},
 			})
 		}
@@ -142,3 +205,75 @@ func (o *OpenAI) RunInference(ctx context.Context, tools []tool.Tool, conversati
 
 	return message, nil
 }
+
+// openAIFields are the parameters that the client can not send. It has no
+// fields for top_k, min_p, repeat_penalty and the extras, and it leaves out a
+// temperature or top_p of zero.
+func openAIFields(p Params) map[string]any {
+	fields := make(map[string]any)
+	for name, v := range map[string]any{
+		"temperature":    p.Temperature,
+		"top_p":          p.TopP,
+		"top_k":          p.TopK,
+		"min_p":          p.MinP,
+		"repeat_penalty": p.RepeatPenalty,
+	} {
+		if !reflect.ValueOf(v).IsNil() {
+			fields[name] = v
+		}
+	}
+	maps.Copy(fields, p.Extra)
+
+	return fields
+}
+
+// retryAfterKey holds a *time.Duration in the context of a request, in which
+// openAITransport stores the Retry-After of an error response. The errors of
+// go-openai do not have the headers.
+type retryAfterKey struct{}
+
+// openAITransport adds fields to the JSON body of every request, and keeps
+// the Retry-After header of errors.
+type openAITransport struct {
+	fields map[string]any
+}
+
+func (ot *openAITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, err := ot.addFields(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if wait, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok && resp.StatusCode >= http.StatusBadRequest {
+		*wait = retryAfter(resp.Header)
+	}
+
+	return resp, nil
+}
+
+func (ot *openAITransport) addFields(req *http.Request) (*http.Request, error) {
+	if len(ot.fields) == 0 || req.Body == nil || req.Method != http.MethodPost {
+		return req, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request: %w", err)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("failed to parse request: %w", err)
+	}
+	if data, err = marshalWithExtra(body, ot.fields); err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+
+	return req, nil
+}
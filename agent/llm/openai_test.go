@@ -0,0 +1,28 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAINoChoices(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"id": "gen-1", "choices": []any{}})
+	}))
+	defer srv.Close()
+
+	o, err := NewLLM(testProvider("openai", srv.URL+"/v1"), contractModel, "")
+	if err != nil {
+		t.Fatalf("could not create openai: %v", err)
+	}
+	_, err = o.RunInference(context.Background(), nil, []Message{{
+		Role:    RoleUser,
+		Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "no choices") {
+		t.Errorf("expected an error for no choices, got %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Params are the parameters for generating an answer. Parameters that are
+// not set are left to the provider. Not every provider supports every
+// parameter, those that are not supported are ignored.
+type Params struct {
+	MaxTokens     *int     `toml:"max_tokens"`
+	Temperature   *float64 `toml:"temperature"`
+	TopP          *float64 `toml:"top_p"`
+	TopK          *int     `toml:"top_k"`
+	MinP          *float64 `toml:"min_p"`
+	RepeatPenalty *float64 `toml:"repeat_penalty"`
+	Seed          *int     `toml:"seed"`
+	Stop          []string `toml:"stop"`
+	// ThinkingBudget is the number of tokens the model may use to reason
+	// before it answers. Zero turns reasoning off for providers that allow
+	// that.
+	ThinkingBudget *int `toml:"thinking_budget"`
+	// Extra holds parameters that are specific to a provider, like
+	// keep_alive for Ollama. They are added to the request as they are.
+	Extra map[string]any `toml:"extra"`
+}
+
+// ParamNames are the names of the parameters that Set knows. Other names are
+// stored in Extra.
+var ParamNames = []string{"max_tokens", "temperature", "top_p", "top_k", "min_p", "repeat_penalty", "seed", "stop", "thinking_budget"}
+
+// Merge returns the parameters with those that are set in o replacing
+// their value.
+func (p Params) Merge(o Params) Params {
+	if o.MaxTokens != nil {
+		p.MaxTokens = o.MaxTokens
+	}
+	if o.Temperature != nil {
+		p.Temperature = o.Temperature
+	}
+	if o.TopP != nil {
+		p.TopP = o.TopP
+	}
+	if o.TopK != nil {
+		p.TopK = o.TopK
+	}
+	if o.MinP != nil {
+		p.MinP = o.MinP
+	}
+	if o.RepeatPenalty != nil {
+		p.RepeatPenalty = o.RepeatPenalty
+	}
+	if o.Seed != nil {
+		p.Seed = o.Seed
+	}
+	if o.Stop != nil {
+		p.Stop = o.Stop
+	}
+	if o.ThinkingBudget != nil {
+		p.ThinkingBudget = o.ThinkingBudget
+	}
+	if len(o.Extra) > 0 {
+		extra := make(map[string]any, len(p.Extra)+len(o.Extra))
+		for k, v := range p.Extra {
+			extra[k] = v
+		}
+		for k, v := range o.Extra {
+			extra[k] = v
+		}
+		p.Extra = extra
+	}
+
+	return p
+}
+
+// Set parses the values and sets the parameter. Stop takes any number of
+// values, the others one. Values of extra parameters are parsed as JSON if
+// possible, and used as text otherwise.
+func (p *Params) Set(name string, values ...string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("no value for %s", name)
+	}
+	if name != "stop" && len(values) > 1 {
+		return fmt.Errorf("%s takes one value", name)
+	}
+	value := values[0]
+
+	// a value that does not parse leaves the parameter as it was
+	old := *p
+	var err error
+	switch name {
+	case "max_tokens":
+		p.MaxTokens, err = parsePtr(value, strconv.Atoi)
+	case "temperature":
+		p.Temperature, err = parsePtr(value, parseFloat)
+	case "top_p":
+		p.TopP, err = parsePtr(value, parseFloat)
+	case "top_k":
+		p.TopK, err = parsePtr(value, strconv.Atoi)
+	case "min_p":
+		p.MinP, err = parsePtr(value, parseFloat)
+	case "repeat_penalty":
+		p.RepeatPenalty, err = parsePtr(value, parseFloat)
+	case "seed":
+		p.Seed, err = parsePtr(value, strconv.Atoi)
+	case "stop":
+		p.Stop = values
+	case "thinking_budget":
+		p.ThinkingBudget, err = parsePtr(value, strconv.Atoi)
+	default:
+		var v any
+		if json.Unmarshal([]byte(value), &v) != nil {
+			v = value
+		}
+		if p.Extra == nil {
+			p.Extra = make(map[string]any)
+		}
+		p.Extra[name] = v
+	}
+	if err != nil {
+		*p = old
+		return fmt.Errorf("invalid value for %s: %q", name, value)
+	}
+
+	return nil
+}
+
+// Unset removes the parameter.
+func (p *Params) Unset(name string) {
+	switch name {
+	case "max_tokens":
+		p.MaxTokens = nil
+	case "temperature":
+		p.Temperature = nil
+	case "top_p":
+		p.TopP = nil
+	case "top_k":
+		p.TopK = nil
+	case "min_p":
+		p.MinP = nil
+	case "repeat_penalty":
+		p.RepeatPenalty = nil
+	case "seed":
+		p.Seed = nil
+	case "stop":
+		p.Stop = nil
+	case "thinking_budget":
+		p.ThinkingBudget = nil
+	default:
+		delete(p.Extra, name)
+	}
+}
+
+// String lists the parameters that are set, one per line.
+func (p Params) String() string {
+	lines := make([]string, 0)
+	add := func(name string, v any) {
+		lines = append(lines, fmt.Sprintf("%s = %v", name, v))
+	}
+	if p.MaxTokens != nil {
+		add("max_tokens", *p.MaxTokens)
+	}
+	if p.Temperature != nil {
+		add("temperature", *p.Temperature)
+	}
+	if p.TopP != nil {
+		add("top_p", *p.TopP)
+	}
+	if p.TopK != nil {
+		add("top_k", *p.TopK)
+	}
+	if p.MinP != nil {
+		add("min_p", *p.MinP)
+	}
+	if p.RepeatPenalty != nil {
+		add("repeat_penalty", *p.RepeatPenalty)
+	}
+	if p.Seed != nil {
+		add("seed", *p.Seed)
+	}
+	if p.Stop != nil {
+		add("stop", fmt.Sprintf("%q", p.Stop))
+	}
+	if p.ThinkingBudget != nil {
+		add("thinking_budget", *p.ThinkingBudget)
+	}
+	extra := make([]string, 0, len(p.Extra))
+	for k := range p.Extra {
+		extra = append(extra, k)
+	}
+	slices.Sort(extra)
+	for _, k := range extra {
+		data, _ := json.Marshal(p.Extra[k])
+		add(k, string(data))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// WithParams returns a copy of the provider where the parameters of the
+// model are merged with params.
+func (p Provider) WithParams(modelName string, params Params) Provider {
+	models := make([]Model, len(p.Models))
+	for i, m := range p.Models {
+		if m.Name == modelName || m.ShortName == modelName {
+			m.Params = m.Params.Merge(params)
+		}
+		models[i] = m
+	}
+	p.Models = models
+
+	return p
+}
+
+// marshalWithExtra marshals v, which must be a struct or map, with the extra
+// fields added to it.
+func marshalWithExtra(v any, extra map[string]any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		fields[k] = v
+	}
+
+	return json.Marshal(fields)
+}
+
+func parsePtr[T any](s string, parse func(string) (T, error)) (*T, error) {
+	v, err := parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,188 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParamsSet(t *testing.T) {
+	var p Params
+	for _, args := range [][]string{
+		{"temperature", "0.5"},
+		{"max_tokens", "100"},
+		{"stop", "END", "###"},
+		{"keep_alive", "5m"},
+		{"num_gpu", "2"},
+	} {
+		if err := p.Set(args[0], args[1:]...); err != nil {
+			t.Fatalf("could not set %s: %v", args[0], err)
+		}
+	}
+	for _, args := range [][]string{{"temperature", "hot"}, {"seed"}, {"top_k", "1", "2"}} {
+		if err := p.Set(args[0], args[1:]...); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+	exp := "max_tokens = 100\ntemperature = 0.5\nstop = [\"END\" \"###\"]\nkeep_alive = \"5m\"\nnum_gpu = 2"
+	if act := p.String(); act != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, act)
+	}
+
+	p.Unset("temperature")
+	p.Unset("keep_alive")
+	if p.Temperature != nil || len(p.Extra) != 1 {
+		t.Errorf("expected temperature and keep_alive to be removed, got %s", p)
+	}
+
+	temp, topK := 0.1, 5
+	base := Params{Temperature: &temp, TopK: &topK, Extra: map[string]any{"a": 1}}
+	merged := base.Merge(p)
+	if *merged.Temperature != temp || *merged.TopK != topK || *merged.MaxTokens != 100 || !reflect.DeepEqual(merged.Extra, map[string]any{"a": 1, "num_gpu": float64(2)}) {
+		t.Errorf("unexpected merge result: %s", merged)
+	}
+	if len(base.Extra) != 1 {
+		t.Errorf("expected merge to leave the original alone, got %v", base.Extra)
+	}
+}
+
+// TestParamsInRequest checks that every provider puts the parameters in the
+// right place of the request.
+func TestParamsInRequest(t *testing.T) {
+	maxTokens, temp, topK, seed := 100, 0.5, 20, 7
+	params := Params{
+		MaxTokens:   &maxTokens,
+		Temperature: &temp,
+		TopK:        &topK,
+		Seed:        &seed,
+		Stop:        []string{"END"},
+	}
+	for _, tc := range []struct {
+		si    standIn
+		path  string
+		extra map[string]any
+		// zero sets temperature and top_p to zero, which must still be sent
+		zero bool
+		exp  map[string]any
+	}{
+		{
+			si:    claudeStandIn(),
+			extra: map[string]any{"metadata": map[string]any{"user_id": "henk"}},
+			exp: map[string]any{
+				"max_tokens":     100.0,
+				"temperature":    0.5,
+				"top_k":          20.0,
+				"stop_sequences": []any{"END"},
+				"metadata":       map[string]any{"user_id": "henk"},
+			},
+		},
+		{
+			si:    openAIStandIn(),
+			path:  "/v1",
+			extra: map[string]any{"provider": map[string]any{"sort": "price"}},
+			exp: map[string]any{
+				"max_tokens":  100.0,
+				"temperature": 0.5,
+				"top_k":       20.0,
+				"seed":        7.0,
+				"stop":        []any{"END"},
+				"provider":    map[string]any{"sort": "price"},
+			},
+		},
+		{
+			si:    openAIStandIn(),
+			path:  "/v1",
+			zero:  true,
+			extra: map[string]any{"reasoning_effort": "low"},
+			exp: map[string]any{
+				"temperature":      0.0,
+				"top_p":            0.0,
+				"reasoning_effort": "low",
+			},
+		},
+		{
+			si:    localStandIn(),
+			path:  "/v1",
+			extra: map[string]any{"cache_prompt": true},
+			exp: map[string]any{
+				"max_tokens":   100.0,
+				"temperature":  0.5,
+				"top_k":        20.0,
+				"seed":         7.0,
+				"stop":         []any{"END"},
+				"cache_prompt": true,
+			},
+		},
+		{
+			si:    ollamaStandIn(),
+			extra: map[string]any{"keep_alive": "5m", "num_gpu": 1},
+			exp: map[string]any{
+				"keep_alive": "5m",
+				"options": map[string]any{
+					"num_predict": 100.0,
+					"temperature": 0.5,
+					"top_k":       20.0,
+					"seed":        7.0,
+					"stop":        []any{"END"},
+					"num_gpu":     1.0,
+				},
+			},
+		},
+		{
+			si:    geminiStandIn(),
+			path:  "/v1beta",
+			extra: map[string]any{"thinkingConfig": map[string]any{"thinkingBudget": 0}},
+			exp: map[string]any{
+				"generationConfig": map[string]any{
+					"maxOutputTokens": 100.0,
+					"temperature":     0.5,
+					"topK":            20.0,
+					"seed":            7.0,
+					"stopSequences":   []any{"END"},
+					"thinkingConfig":  map[string]any{"thinkingBudget": 0.0},
+				},
+			},
+		},
+	} {
+		t.Run(tc.si.name, func(t *testing.T) {
+			var body map[string]any
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				if err := json.Unmarshal(data, &body); err != nil {
+					t.Errorf("could not parse request: %v", err)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				tc.si.respond(w, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "ok"}}})
+			}))
+			defer srv.Close()
+
+			p := params
+			p.Extra = tc.extra
+			if tc.zero {
+				zero := 0.0
+				p.Temperature, p.TopP = &zero, &zero
+			}
+			provider := testProvider(tc.si.name, srv.URL+tc.path)
+			provider.Models[0].Params = p
+			client, err := NewLLM(provider, contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create client: %v", err)
+			}
+			if _, err := client.RunInference(context.Background(), nil, []Message{{
+				Role:    RoleUser,
+				Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}},
+			}}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for k, exp := range tc.exp {
+				if act := body[k]; !reflect.DeepEqual(act, exp) {
+					t.Errorf("%s: expected %v, got %v", k, exp, act)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+// Fixture is a list of requests and the responses to them, as used by the
+// replay provider.
+type Fixture struct {
+	Exchanges []Exchange `json:"exchanges"`
+}
+
+type Exchange struct {
+	Request  []Message `json:"request,omitempty"`
+	Response Message   `json:"response"`
+	// Error is returned instead of the response, to replay a failing
+	// provider.
+	Error *APIError `json:"error,omitempty"`
+}
+
+func ReadFixture(path string) (Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Fixture{}, fmt.Errorf("could not read fixture: %w", err)
+	}
+	var f Fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return Fixture{}, fmt.Errorf("could not parse fixture %s: %w", path, err)
+	}
+
+	return f, nil
+}
+
+func (f Fixture) Write(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal fixture: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("could not write fixture: %w", err)
+	}
+
+	return nil
+}
+
+// Replay answers with the responses from a fixture, in order, regardless of
+// the request. It does not need a network and is meant for testing.
+type Replay struct {
+	provider       Provider
+	modelName      string
+	modelShortName string
+	exchanges      []Exchange
+	next           int
+	mu             sync.Mutex
+}
+
+func NewReplay(provider Provider, modelName string) (*Replay, error) {
+	m, ok := provider.Model(modelName)
+	if !ok {
+		return nil, fmt.Errorf("%w: could not find model %q in provider %q", ErrUnknownModel, modelName, provider.Name)
+	}
+	f, err := ReadFixture(provider.Fixture)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Replay{
+		provider:       provider,
+		modelName:      m.Name,
+		modelShortName: m.ShortName,
+		exchanges:      f.Exchanges,
+	}, nil
+}
+
+func (r *Replay) ModelInfo() (string, string, string) {
+	return r.provider.Name, r.modelName, r.modelShortName
+}
+
+func (r *Replay) RunInference(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next >= len(r.exchanges) {
+		return Message{}, fmt.Errorf("fixture has no more responses, %d were used", len(r.exchanges))
+	}
+	ex := r.exchanges[r.next]
+	r.next++
+	if ex.Error != nil {
+		return Message{}, ex.Error
+	}
+
+	return ex.Response, nil
+}
+
+// Recorder passes all requests to another LLM and stores them together with
+// the responses in a fixture file, that is rewritten after every exchange.
+type Recorder struct {
+	llm     LLM
+	path    string
+	fixture Fixture
+	mu      sync.Mutex
+}
+
+func NewRecorder(llm LLM, path string) *Recorder {
+	return &Recorder{
+		llm:     llm,
+		path:    path,
+		fixture: Fixture{Exchanges: make([]Exchange, 0)},
+	}
+}
+
+func (r *Recorder) ModelInfo() (string, string, string) {
+	return r.llm.ModelInfo()
+}
+
+func (r *Recorder) RunInference(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
+	resp, err := r.llm.RunInference(ctx, tools, conversation)
+	if err != nil {
+		return Message{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	request := make([]Message, len(conversation))
+	copy(request, conversation)
+	r.fixture.Exchanges = append(r.fixture.Exchanges, Exchange{
+		Request:  request,
+		Response: resp,
+	})
+	if err := r.fixture.Write(r.path); err != nil {
+		return Message{}, err
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,60 @@
+package llm
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	source := Fixture{Exchanges: []Exchange{
+		{Response: Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "hello"}}}},
+		{Response: Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeToolUse, ToolUse: ToolUse{ID: "1", Name: "list_files", Input: []byte(`{"path":"."}`)}}}}},
+	}}
+	sourcePath := filepath.Join(dir, "source.json")
+	if err := source.Write(sourcePath); err != nil {
+		t.Fatalf("could not write fixture: %v", err)
+	}
+	recordPath := filepath.Join(dir, "recorded.json")
+
+	client, err := NewLLM(Provider{
+		Type:    "replay",
+		Name:    "replay",
+		Fixture: sourcePath,
+		Record:  recordPath,
+		Models:  []Model{{Name: "fake"}},
+	}, "fake", "")
+	if err != nil {
+		t.Fatalf("could not create llm: %v", err)
+	}
+
+	conv := []Message{{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}}}}
+	for i, exp := range source.Exchanges {
+		act, err := client.RunInference(context.Background(), nil, conv)
+		if err != nil {
+			t.Fatalf("exchange %d: unexpected error: %v", i, err)
+		}
+		if act.Content[0].Type != exp.Response.Content[0].Type {
+			t.Errorf("exchange %d: expected %v, got %v", i, exp.Response, act)
+		}
+		conv = append(conv, act)
+	}
+	if _, err := client.RunInference(context.Background(), nil, conv); err == nil {
+		t.Errorf("expected error when fixture is used up")
+	}
+
+	recorded, err := ReadFixture(recordPath)
+	if err != nil {
+		t.Fatalf("could not read recorded fixture: %v", err)
+	}
+	if len(recorded.Exchanges) != 2 {
+		t.Fatalf("expected 2 recorded exchanges, got %d", len(recorded.Exchanges))
+	}
+	if len(recorded.Exchanges[1].Request) != 2 {
+		t.Errorf("expected 2 messages in second request, got %d", len(recorded.Exchanges[1].Request))
+	}
+	if recorded.Exchanges[1].Response.Content[0].ToolUse.Name != "list_files" {
+		t.Errorf("expected recorded tool use, got %v", recorded.Exchanges[1].Response)
+	}
+}
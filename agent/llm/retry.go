@@ -0,0 +1,266 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/sashabaranov/go-openai"
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+const (
+	defaultMaxAttempts = 4
+	retryBaseDelay     = 2 * time.Second
+	retryMaxDelay      = time.Minute
+)
+
+// RetryConfig sets how often a request to a provider is tried before the
+// error is returned.
+type RetryConfig struct {
+	// MaxAttempts is the number of tries, including the first one. Zero uses
+	// the default, one turns retrying off.
+	MaxAttempts int `toml:"max_attempts"`
+	// Timeout is the time one try may take. Zero means no limit.
+	Timeout time.Duration `toml:"timeout"`
+}
+
+// APIError is an error response of a provider.
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// RetryAfter is the time the provider asked to wait before trying
+	// again, zero if it did not say.
+	RetryAfter time.Duration `json:"retry_after,omitempty"`
+}
+
+func newAPIError(resp *http.Response) *APIError {
+	body, _ := io.ReadAll(resp.Body)
+	return &APIError{
+		Status:     resp.StatusCode,
+		Message:    errorMessage(body),
+		RetryAfter: retryAfter(resp.Header),
+	}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API request failed with status %d: %s", e.Status, e.Message)
+}
+
+// waitError adds the Retry-After of the response to an error of an SDK that
+// does not keep the headers.
+type waitError struct {
+	err  error
+	wait time.Duration
+}
+
+func withWait(err error, wait time.Duration) error {
+	if wait == 0 {
+		return err
+	}
+
+	return &waitError{err: err, wait: wait}
+}
+
+func (e *waitError) Error() string { return e.err.Error() }
+func (e *waitError) Unwrap() error { return e.err }
+
+// errorMessage finds the message in an error response. Servers put it in
+// different places.
+func errorMessage(body []byte) string {
+	var structured struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &structured); err == nil && structured.Error.Message != "" {
+		return structured.Error.Message
+	}
+	var plain struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &plain); err == nil {
+		if plain.Error != "" {
+			return plain.Error
+		}
+		if plain.Message != "" {
+			return plain.Message
+		}
+	}
+
+	return strings.TrimSpace(string(body))
+}
+
+// retryAfter reads the Retry-After header, which is either a number of
+// seconds or a date.
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+
+	return 0
+}
+
+// Retry is an LLM that tries a request again when it failed with an error
+// that may go away, like a rate limit, an overloaded server or a lost
+// connection. Other errors are returned right away.
+type Retry struct {
+	LLM
+	config RetryConfig
+	notify func(string)
+	sleep  func(ctx context.Context, d time.Duration) error
+}
+
+// NewRetry wraps the client. Notify is called with a short explanation
+// before each new try, it can be nil.
+func NewRetry(client LLM, config RetryConfig, notify func(string)) *Retry {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if notify == nil {
+		notify = func(string) {}
+	}
+
+	return &Retry{
+		LLM:    client,
+		config: config,
+		notify: notify,
+		sleep:  sleep,
+	}
+}
+
+func (r *Retry) RunInference(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
+	for attempt := 1; ; attempt++ {
+		msg, err := r.try(ctx, tools, conversation)
+		if err == nil {
+			return msg, nil
+		}
+		if ctx.Err() != nil {
+			return Message{}, err
+		}
+		reason, wait, ok := retryable(err)
+		if !ok {
+			return Message{}, err
+		}
+		if attempt >= r.config.MaxAttempts {
+			return Message{}, fmt.Errorf("%w (gave up after %d attempts)", err, attempt)
+		}
+
+		if wait == 0 {
+			wait = backoff(attempt)
+		}
+		// a provider can ask for a wait of hours, which would hang the turn
+		wait = min(wait, retryMaxDelay)
+		if deadline, ok := ctx.Deadline(); ok {
+			wait = min(wait, max(time.Until(deadline), 0))
+		}
+		r.notify(fmt.Sprintf("%s, retrying in %s (attempt %d of %d)", reason, wait.Round(time.Second), attempt+1, r.config.MaxAttempts))
+		if err := r.sleep(ctx, wait); err != nil {
+			return Message{}, err
+		}
+	}
+}
+
+func (r *Retry) try(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
+	if r.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+	}
+
+	return r.LLM.RunInference(ctx, tools, conversation)
+}
+
+// Transient tells whether the error is caused by the provider or the
+// connection, and not by the request, the key or the conversation. Another
+// model may succeed where this one failed with such an error.
+func Transient(err error) bool {
+	_, _, ok := retryable(err)
+
+	return ok
+}
+
+// retryable tells whether the error may go away when the request is tried
+// again. It returns a description for the user and the wait time the
+// provider asked for, if any.
+func retryable(err error) (string, time.Duration, bool) {
+	status, wait := 0, time.Duration(0)
+	var waitErr *waitError
+	if errors.As(err, &waitErr) {
+		wait = waitErr.wait
+	}
+	var apiErr *APIError
+	var antErr *anthropic.Error
+	var oaiErr *openai.APIError
+	var oaiReqErr *openai.RequestError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &apiErr):
+		status, wait = apiErr.Status, apiErr.RetryAfter
+	case errors.As(err, &antErr):
+		status = antErr.StatusCode
+		if antErr.Response != nil {
+			wait = retryAfter(antErr.Response.Header)
+		}
+	case errors.As(err, &oaiErr):
+		status = oaiErr.HTTPStatusCode
+	case errors.As(err, &oaiReqErr):
+		status = oaiReqErr.HTTPStatusCode
+	case errors.Is(err, context.DeadlineExceeded):
+		return "request timed out", 0, true
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return "connection failed", 0, true
+	default:
+		return "", 0, false
+	}
+
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate limited", wait, true
+	// 529 is what Anthropic returns when it is overloaded
+	case status == http.StatusServiceUnavailable || status == 529:
+		return "provider overloaded", wait, true
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return "request timed out", wait, true
+	case status >= 500:
+		return fmt.Sprintf("server error %d", status), wait, true
+	default:
+		return "", 0, false
+	}
+}
+
+// backoff doubles the wait for every attempt, with jitter so that clients do
+// not retry at the same moment.
+func backoff(attempt int) time.Duration {
+	d := min(retryBaseDelay<<min(attempt-1, 10), retryMaxDelay)
+
+	return d/2 + rand.N(d/2+1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
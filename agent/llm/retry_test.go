@@ -0,0 +1,243 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+// failingLLM returns the errors in order, and an answer when they are used
+// up.
+type failingLLM struct {
+	errs  []error
+	calls int
+}
+
+func (f *failingLLM) ModelInfo() (string, string, string) { return "test", "test", "" }
+
+func (f *failingLLM) RunInference(ctx context.Context, tools []tool.Tool, conversation []Message) (Message, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return Message{}, err
+	}
+
+	return Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "ok"}}}, nil
+}
+
+func TestRetry(t *testing.T) {
+	rateLimited := &APIError{Status: http.StatusTooManyRequests, Message: "slow down", RetryAfter: 8 * time.Second}
+	overloaded := fmt.Errorf("wrapped: %w", &APIError{Status: 529, Message: "overloaded"})
+	badRequest := &APIError{Status: http.StatusBadRequest, Message: "invalid"}
+	for _, tc := range []struct {
+		name        string
+		errs        []error
+		maxAttempts int
+		expErr      error
+		expCalls    int
+		expNotes    []string
+	}{
+		{
+			name:     "success",
+			expCalls: 1,
+			expNotes: []string{},
+		},
+		{
+			name:     "retry after",
+			errs:     []error{rateLimited},
+			expCalls: 2,
+			expNotes: []string{"rate limited, retrying in 8s (attempt 2 of 4)"},
+		},
+		{
+			name:     "backoff",
+			errs:     []error{overloaded, overloaded},
+			expCalls: 3,
+			expNotes: []string{"provider overloaded, retrying in", "provider overloaded, retrying in"},
+		},
+		{
+			name:     "fatal",
+			errs:     []error{badRequest},
+			expErr:   badRequest,
+			expCalls: 1,
+			expNotes: []string{},
+		},
+		{
+			name:        "give up",
+			errs:        []error{rateLimited, rateLimited, rateLimited},
+			maxAttempts: 2,
+			expErr:      rateLimited,
+			expCalls:    2,
+			expNotes:    []string{"rate limited, retrying in 8s (attempt 2 of 2)"},
+		},
+		{
+			name:     "long retry after",
+			errs:     []error{&APIError{Status: http.StatusTooManyRequests, RetryAfter: 5 * time.Hour}},
+			expCalls: 2,
+			expNotes: []string{"rate limited, retrying in 1m0s (attempt 2 of 4)"},
+		},
+		{
+			name:     "connection",
+			errs:     []error{fmt.Errorf("failed to make request: %w", &netError{})},
+			expCalls: 2,
+			expNotes: []string{"connection failed, retrying in"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &failingLLM{errs: tc.errs}
+			notes := make([]string, 0)
+			r := NewRetry(client, RetryConfig{MaxAttempts: tc.maxAttempts}, func(msg string) {
+				notes = append(notes, msg)
+			})
+			waits := make([]time.Duration, 0)
+			r.sleep = func(ctx context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+
+			_, err := r.RunInference(context.Background(), nil, nil)
+			if !errors.Is(err, tc.expErr) {
+				t.Errorf("expected error %v, got %v", tc.expErr, err)
+			}
+			if client.calls != tc.expCalls {
+				t.Errorf("expected %d calls, got %d", tc.expCalls, client.calls)
+			}
+			if len(notes) != len(tc.expNotes) {
+				t.Fatalf("expected notes %v, got %v", tc.expNotes, notes)
+			}
+			for i := range notes {
+				if !strings.HasPrefix(notes[i], tc.expNotes[i]) {
+					t.Errorf("expected note %q, got %q", tc.expNotes[i], notes[i])
+				}
+			}
+			for i, w := range waits {
+				if limit := retryBaseDelay << i; tc.name == "backoff" && (w < limit/2 || w > limit) {
+					t.Errorf("expected wait %d between %s and %s, got %s", i, limit/2, limit, w)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &failingLLM{errs: []error{&APIError{Status: http.StatusServiceUnavailable}}}
+	r := NewRetry(client, RetryConfig{}, nil)
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+
+	if _, err := r.RunInference(ctx, nil, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait to be canceled, got %v", err)
+	}
+	if client.calls != 1 {
+		t.Errorf("expected 1 call, got %d", client.calls)
+	}
+}
+
+func TestRetryProvider(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "3")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{"error": "model is loading"})
+			return
+		}
+		ollamaStandIn().respond(w, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "ok"}}})
+	}))
+	defer srv.Close()
+
+	client, err := NewOllama(testProvider("ollama", srv.URL), contractModel, "")
+	if err != nil {
+		t.Fatalf("could not create ollama: %v", err)
+	}
+	var note string
+	r := NewRetry(client, RetryConfig{}, func(msg string) { note = msg })
+	r.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+
+	msg, err := r.RunInference(context.Background(), nil, []Message{{
+		Role:    RoleUser,
+		Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Content[0].Text != "ok" || calls != 2 {
+		t.Errorf("expected an answer after 2 calls, got %+v after %d", msg, calls)
+	}
+	if exp := "provider overloaded, retrying in 3s (attempt 2 of 4)"; note != exp {
+		t.Errorf("expected %q, got %q", exp, note)
+	}
+}
+
+// TestRetryOpenAI checks that the Retry-After header is used, although the
+// errors of go-openai do not have it.
+func TestRetryOpenAI(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "7")
+			writeJSON(w, http.StatusTooManyRequests, map[string]any{"error": map[string]any{"message": "slow down", "type": "rate_limit"}})
+			return
+		}
+		openAIStandIn().respond(w, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "ok"}}})
+	}))
+	defer srv.Close()
+
+	client, err := NewOpenAI(testProvider("openai", srv.URL+"/v1"), contractModel, "")
+	if err != nil {
+		t.Fatalf("could not create openai: %v", err)
+	}
+	var note string
+	r := NewRetry(client, RetryConfig{}, func(msg string) { note = msg })
+	r.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+
+	if _, err := r.RunInference(context.Background(), nil, []Message{{
+		Role:    RoleUser,
+		Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}},
+	}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := "rate limited, retrying in 7s (attempt 2 of 4)"; note != exp {
+		t.Errorf("expected %q, got %q", exp, note)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		exp   time.Duration
+	}{
+		{"", 0},
+		{"12", 12 * time.Second},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	} {
+		header := http.Header{}
+		header.Set("Retry-After", tc.value)
+		if act := retryAfter(header); act != tc.exp {
+			t.Errorf("%q: expected %s, got %s", tc.value, tc.exp, act)
+		}
+	}
+	header := http.Header{}
+	header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if act := retryAfter(header); act < 50*time.Second || act > time.Minute {
+		t.Errorf("expected about a minute, got %s", act)
+	}
+}
+
+type netError struct{}
+
+func (netError) Error() string   { return "connection refused" }
+func (netError) Timeout() bool   { return false }
+func (netError) Temporary() bool { return false }
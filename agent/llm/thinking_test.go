@@ -0,0 +1,226 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSplitThinking(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		text        string
+		expThinking string
+		expAnswer   string
+	}{
+		{
+			name:      "none",
+			text:      "  just an answer\n",
+			expAnswer: "  just an answer\n",
+		},
+		{
+			name:        "tags",
+			text:        "<think>\nfirst this\n</think>\n\nthe answer",
+			expThinking: "first this",
+			expAnswer:   "the answer",
+		},
+		{
+			name:        "closing only",
+			text:        "opened in the prompt</think>the answer",
+			expThinking: "opened in the prompt",
+			expAnswer:   "the answer",
+		},
+		{
+			name:        "twice",
+			text:        "<think>one</think>a <think>two</think>b",
+			expThinking: "one\n\ntwo",
+			expAnswer:   "a b",
+		},
+		{
+			name:        "cut off",
+			text:        "<think>still thinking",
+			expThinking: "still thinking",
+		},
+		{
+			name:      "empty",
+			text:      "<think></think>the answer",
+			expAnswer: "the answer",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			thinking, answer := splitThinking(tc.text)
+			if thinking != tc.expThinking || answer != tc.expAnswer {
+				t.Errorf("expected %q and %q, got %q and %q", tc.expThinking, tc.expAnswer, thinking, answer)
+			}
+		})
+	}
+}
+
+// TestThinkingResponses checks that reasoning is read from every provider,
+// whether it comes in its own field or in the text.
+func TestThinkingResponses(t *testing.T) {
+	for _, tc := range []struct {
+		provider string
+		path     string
+		response map[string]any
+		exp      []ContentBlock
+	}{
+		{
+			provider: "claude",
+			response: map[string]any{
+				"id":    "msg_1",
+				"type":  "message",
+				"role":  "assistant",
+				"model": contractModel,
+				"content": []map[string]any{
+					{"type": "thinking", "thinking": "reason", "signature": "sig"},
+					{"type": "redacted_thinking", "data": "secret"},
+					{"type": "text", "text": "answer"},
+				},
+				"usage": map[string]any{"input_tokens": 10, "output_tokens": 5},
+			},
+			exp: []ContentBlock{
+				{Type: ContentTypeThinking, Thinking: Thinking{Text: "reason", Signature: "sig"}},
+				{Type: ContentTypeThinking, Thinking: Thinking{Redacted: "secret"}},
+				{Type: ContentTypeText, Text: "answer"},
+			},
+		},
+		{
+			provider: "openai",
+			path:     "/v1",
+			response: map[string]any{
+				"choices": []map[string]any{{
+					"message": map[string]any{"role": "assistant", "content": "answer", "reasoning_content": "reason"},
+				}},
+			},
+			exp: []ContentBlock{
+				{Type: ContentTypeThinking, Thinking: Thinking{Text: "reason"}},
+				{Type: ContentTypeText, Text: "answer"},
+			},
+		},
+		{
+			provider: "local",
+			path:     "/v1",
+			response: map[string]any{
+				"choices": []map[string]any{{
+					"message": map[string]any{"role": "assistant", "content": "<think>reason</think>\nanswer"},
+				}},
+			},
+			exp: []ContentBlock{
+				{Type: ContentTypeThinking, Thinking: Thinking{Text: "reason"}},
+				{Type: ContentTypeText, Text: "answer"},
+			},
+		},
+		{
+			provider: "ollama",
+			response: map[string]any{
+				"message": map[string]any{"role": "assistant", "content": "answer", "thinking": "reason"},
+				"done":    true,
+			},
+			exp: []ContentBlock{
+				{Type: ContentTypeThinking, Thinking: Thinking{Text: "reason"}},
+				{Type: ContentTypeText, Text: "answer"},
+			},
+		},
+		{
+			provider: "gemini",
+			path:     "/v1beta",
+			response: map[string]any{
+				"candidates": []map[string]any{{
+					"content": map[string]any{
+						"role":  "model",
+						"parts": []map[string]any{{"text": "reason", "thought": true}, {"text": "answer"}},
+					},
+				}},
+			},
+			exp: []ContentBlock{
+				{Type: ContentTypeThinking, Thinking: Thinking{Text: "reason"}},
+				{Type: ContentTypeText, Text: "answer"},
+			},
+		},
+	} {
+		t.Run(tc.provider, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				writeJSON(w, http.StatusOK, tc.response)
+			}))
+			defer srv.Close()
+
+			client, err := NewLLM(testProvider(tc.provider, srv.URL+tc.path), contractModel, contractSystemPrompt)
+			if err != nil {
+				t.Fatalf("could not create client: %v", err)
+			}
+			msg, err := client.RunInference(context.Background(), nil, []Message{{
+				Role:    RoleUser,
+				Content: []ContentBlock{{Type: ContentTypeText, Text: "hi"}},
+			}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(msg.Content, tc.exp) {
+				t.Errorf("expected %+v, got %+v", tc.exp, msg.Content)
+			}
+		})
+	}
+}
+
+// TestClaudeThinking checks that signed thinking goes back to Claude during a
+// tool loop and that the budget leaves room for the answer.
+func TestClaudeThinking(t *testing.T) {
+	var body struct {
+		MaxTokens int `json:"max_tokens"`
+		Thinking  struct {
+			Type         string `json:"type"`
+			BudgetTokens int    `json:"budget_tokens"`
+		} `json:"thinking"`
+		Messages []struct {
+			Content []map[string]any `json:"content"`
+		} `json:"messages"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("could not parse request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		claudeStandIn().respond(w, Message{Role: RoleAssistant, Content: []ContentBlock{{Type: ContentTypeText, Text: "ok"}}})
+	}))
+	defer srv.Close()
+
+	budget, maxTokens := 10000, 4000
+	provider := testProvider("claude", srv.URL)
+	provider.Models[0].Params = Params{ThinkingBudget: &budget, MaxTokens: &maxTokens}
+	c, err := NewClaude(provider, contractModel, contractSystemPrompt)
+	if err != nil {
+		t.Fatalf("could not create claude: %v", err)
+	}
+	if _, err := c.RunInference(context.Background(), nil, []Message{
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeText, Text: "read it"}}},
+		{Role: RoleAssistant, Content: []ContentBlock{
+			{Type: ContentTypeThinking, Thinking: Thinking{Text: "from another model"}},
+			{Type: ContentTypeThinking, Thinking: Thinking{Text: "reason", Signature: "sig"}},
+			{Type: ContentTypeToolUse, ToolUse: ToolUse{ID: "call_1", Name: "read_file", Input: json.RawMessage(`{}`)}},
+		}},
+		{Role: RoleUser, Content: []ContentBlock{{Type: ContentTypeToolResult, ToolResult: ToolResult{ID: "call_1", Result: "text"}}}},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if body.Thinking.Type != "enabled" || body.Thinking.BudgetTokens != budget || body.MaxTokens != budget+claudeMaxTokens {
+		t.Errorf("expected thinking with budget %d and room for the answer, got %+v and max_tokens %d", budget, body.Thinking, body.MaxTokens)
+	}
+	if len(body.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(body.Messages))
+	}
+	exp := []map[string]any{
+		{"type": "thinking", "thinking": "reason", "signature": "sig"},
+		{"type": "tool_use", "id": "call_1", "name": "read_file", "input": map[string]any{}},
+	}
+	if act := body.Messages[1].Content; !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
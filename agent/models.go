@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go-mod.ewintr.nl/henk/agent/llm"
+	"go-mod.ewintr.nl/henk/agent/tool"
+)
+
+// RemoteModels lists the models that the providers offer, and looks up the
+// configured ones, which can be aliases that are not in the list. The result
+// is markdown.
+func RemoteModels(ctx context.Context, config Config) string {
+	var b strings.Builder
+	for _, p := range config.Providers {
+		fmt.Fprintf(&b, "**%s** (%s)\n\n", p.Name, p.Type)
+		remote, err := llm.ListModels(ctx, p)
+		if err != nil {
+			fmt.Fprintf(&b, "could not list models: %v\n\n", err)
+			continue
+		}
+		configured := make(map[string]bool)
+		for _, m := range p.Models {
+			r, err := llm.FindModel(ctx, p, m.Name)
+			switch {
+			case errors.Is(err, llm.ErrModelNotFound):
+				fmt.Fprintf(&b, "- %s: not offered by the provider\n", m.Name)
+				continue
+			case err != nil:
+				fmt.Fprintf(&b, "- %s: could not look up: %v\n", m.Name, err)
+				continue
+			}
+			configured[r.Name] = true
+			fmt.Fprintf(&b, "- %s: %s\n", m.Name, strings.Join(describe(m, r), ", "))
+		}
+		others := make([]string, 0)
+		for _, r := range remote {
+			if !configured[r.Name] {
+				others = append(others, r.Name)
+			}
+		}
+		if len(others) > 0 {
+			fmt.Fprintf(&b, "- not configured: %s\n", strings.Join(others, ", "))
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// describe summarizes what is known about a configured model.
+func describe(m llm.Model, r llm.RemoteModel) []string {
+	info := []string{"available"}
+	if r.ContextSize > 0 {
+		info = append(info, fmt.Sprintf("context %d", r.ContextSize))
+		if m.ContextSize > r.ContextSize {
+			info = append(info, fmt.Sprintf("context_size %d is larger than the model supports", m.ContextSize))
+		}
+	}
+	if tools, known := r.Supports(llm.CapabilityTools); known && tools {
+		info = append(info, "tools")
+	} else if known {
+		info = append(info, "no tools")
+	}
+
+	return info
+}
+
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "FAIL"
+)
+
+// Doctor checks for every provider whether it can be reached with the API
+// key, and for every model whether the provider offers it and whether it
+// can use tools. When the provider does not tell about tools, the model is
+// asked to call one, which uses a few tokens. It returns false if a check
+// failed.
+func Doctor(ctx context.Context, config Config, w io.Writer) bool {
+	ok := true
+	report := func(result, msg string) {
+		if result == checkFail {
+			ok = false
+		}
+		fmt.Fprintf(w, "  %-5s %s\n", result, llm.Redact(msg))
+	}
+
+	for _, p := range config.Providers {
+		fmt.Fprintf(w, "%s (%s)\n", p.Name, p.Type)
+		remote, err := llm.ListModels(ctx, p)
+		var apiErr *llm.APIError
+		switch {
+		case errors.Is(err, llm.ErrListNotSupported):
+			report(checkWarn, "this provider can not be checked")
+			continue
+		case errors.As(err, &apiErr) && (apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden):
+			report(checkFail, fmt.Sprintf("API key was refused: %s", apiErr.Message))
+			continue
+		case err != nil:
+			report(checkFail, fmt.Sprintf("could not connect: %v", err))
+			continue
+		}
+		report(checkOK, fmt.Sprintf("connected, %d models offered", len(remote)))
+
+		for _, m := range p.Models {
+			r, err := llm.FindModel(ctx, p, m.Name)
+			switch {
+			case errors.Is(err, llm.ErrModelNotFound) && p.Type == "local":
+				// llama-server lists the file of the model, not the name
+				report(checkWarn, fmt.Sprintf("%s: not listed, the server may know it under another name", m.Name))
+			case errors.Is(err, llm.ErrModelNotFound):
+				report(checkFail, fmt.Sprintf("%s: not offered by the provider", m.Name))
+				continue
+			case err != nil:
+				report(checkFail, fmt.Sprintf("%s: could not look up: %v", m.Name, err))
+				continue
+			}
+			if tools, known := r.Supports(llm.CapabilityTools); known {
+				if tools {
+					report(checkOK, fmt.Sprintf("%s: supports tools", m.Name))
+				} else {
+					report(checkWarn, fmt.Sprintf("%s: does not support tools", m.Name))
+				}
+				continue
+			}
+			result, msg := probeTools(ctx, p, m.Name)
+			report(result, fmt.Sprintf("%s: %s", m.Name, msg))
+		}
+	}
+
+	return ok
+}
+
+// probeTools asks the model to call a tool and checks whether it did.
+func probeTools(ctx context.Context, provider llm.Provider, modelName string) (string, string) {
+	client, err := llm.NewLLM(provider, modelName, "You are a helpful assistant that uses tools when asked.")
+	if err != nil {
+		return checkFail, err.Error()
+	}
+	msg, err := client.RunInference(ctx, []tool.Tool{tool.NewListFiles()}, []llm.Message{
+		userMessage("Use the list_files tool to list the files in the current directory."),
+	})
+	if err != nil {
+		return checkFail, fmt.Sprintf("request failed: %v", err)
+	}
+	for _, c := range msg.Content {
+		if c.Type == llm.ContentTypeToolUse {
+			return checkOK, "calls tools"
+		}
+	}
+
+	return checkWarn, "answered without calling the tool, it may not support tools"
+}
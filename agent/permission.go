@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyAsk   = "ask"
+	PolicyDeny  = "deny"
+)
+
+// Permission decides whether a tool can be called. Calls with a path that
+// matches one of the Deny patterns are denied, calls with a path that
+// matches one of the Allow patterns are allowed, and all other calls follow
+// the Policy. Paths are matched relative to the working directory, and paths
+// outside of it never match an Allow pattern.
+//
+// Patterns are globs where * matches within a directory and ** matches
+// across directories, like "*.go" or "docs/**".
+type Permission struct {
+	Policy string   `toml:"policy"`
+	Allow  []string `toml:"allow"`
+	Deny   []string `toml:"deny"`
+}
+
+func (p Permission) Validate() error {
+	switch p.Policy {
+	case "", PolicyAllow, PolicyAsk, PolicyDeny:
+	default:
+		return fmt.Errorf("unknown policy %q", p.Policy)
+	}
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, err := globRegexp(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// PermissionFor returns the permission for the tool, or the default policy if
+// there is none.
+func (tc ToolsConfig) PermissionFor(name string) Permission {
+	p := tc.Permissions[name]
+	if p.Policy == "" {
+		p.Policy = tc.Policy
+	}
+	if p.Policy == "" {
+		p.Policy = PolicyAllow
+	}
+
+	return p
+}
+
+// decide returns the policy that applies to a call with this input.
+func (p Permission) decide(input json.RawMessage) string {
+	var args struct {
+		Path *string `json:"path"`
+	}
+	if err := json.Unmarshal(input, &args); err != nil || args.Path == nil {
+		return p.Policy
+	}
+	path, inside := projectPath(*args.Path)
+	if matchAny(p.Deny, path) {
+		return PolicyDeny
+	}
+	// a pattern like **/*.go must not allow files outside the project
+	if inside && matchAny(p.Allow, path) {
+		return PolicyAllow
+	}
+
+	return p.Policy
+}
+
+// projectPath returns the path relative to the working directory, so that
+// "/abs/project/.env" and "../project/.env" match the same patterns as
+// ".env". A path outside the working directory is returned as an absolute
+// path, and inside is false.
+func projectPath(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.ToSlash(filepath.Clean(path)), false
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return filepath.ToSlash(abs), false
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(abs), false
+	}
+
+	return filepath.ToSlash(rel), true
+}
+
+// approve checks whether the call is permitted, and asks the user if needed.
+// If it is not, the returned error explains why to the model.
+func (a *Agent) approve(name string, input json.RawMessage) error {
+	switch a.config.Tools.PermissionFor(name).decide(input) {
+	case PolicyAllow:
+		return nil
+	case PolicyDeny:
+		return fmt.Errorf("calling %s with this input is not allowed by the user", name)
+	}
+
+	// calls can run concurrently, but the user answers one question at a
+	// time
+	a.approvalMu.Lock()
+	defer a.approvalMu.Unlock()
+	if a.approved[name] {
+		return nil
+	}
+
+	question := fmt.Sprintf("Henk wants to call `%s`. Allow?", formatToolCall(name, input))
+	choice, ok := a.choose(question, []string{"yes, once", "yes, for this session", "no"})
+	if !ok {
+		a.quit()
+		return fmt.Errorf("the user quit")
+	}
+	switch choice {
+	case 0:
+		return nil
+	case 1:
+		a.approved[name] = true
+		return nil
+	}
+
+	a.displayGen("Why not? The reason is sent to Henk, leave it empty to give none.")
+	reason, ok := a.ui.Prompt("")
+	if !ok {
+		a.quit()
+	}
+	if reason = strings.TrimSpace(reason); reason == "" {
+		return fmt.Errorf("the user denied this call")
+	}
+
+	return fmt.Errorf("the user denied this call: %s", reason)
+}
+
+func matchAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if re, err := globRegexp(pattern); err == nil && re.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// globRegexp translates a glob pattern to a regular expression. Unlike
+// filepath.Match, it supports ** to match any number of directories.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				// "**/" also matches no directory at all
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString("(.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
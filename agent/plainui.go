@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PlainUI reads and writes lines of text, without any terminal escape codes.
+// It is meant for dumb terminals and for use with redirected input and
+// output. A line that ends with a backslash is continued on the next line.
+type PlainUI struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	calls   map[string]string
+}
+
+func NewPlainUI(in io.Reader, out io.Writer, cancel context.CancelFunc) *PlainUI {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	return &PlainUI{
+		scanner: scanner,
+		out:     out,
+		cancel:  cancel,
+		calls:   make(map[string]string),
+	}
+}
+
+func (ui *PlainUI) Show(msg Message) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	switch msg.Type {
+	case TypeTool:
+		ui.calls[msg.ID] = msg.Body
+		fmt.Fprintf(ui.out, "%s: %s running...\n\n", sender(msg.Type), msg.Body)
+	case TypeToolResult:
+		// tool results are only shown in the terminal ui, on request
+		call, ok := ui.calls[msg.ID]
+		if !ok {
+			return
+		}
+		delete(ui.calls, msg.ID)
+		fmt.Fprintf(ui.out, "%s: %s done\n\n", sender(TypeTool), call)
+	default:
+		fmt.Fprintf(ui.out, "%s: %s\n\n", sender(msg.Type), msg.Body)
+	}
+}
+
+func (ui *PlainUI) Prompt(initial string) (string, bool) {
+	if initial != "" {
+		fmt.Fprintf(ui.out, "Current message:\n%s\n\nType the new message.\n", initial)
+	}
+	fmt.Fprint(ui.out, "> ")
+
+	lines := make([]string, 0)
+	for ui.scanner.Scan() {
+		line := ui.scanner.Text()
+		if strings.HasSuffix(line, "\\") {
+			lines = append(lines, strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		lines = append(lines, line)
+		fmt.Fprintln(ui.out)
+		return strings.Join(lines, "\n"), true
+	}
+
+	return "", false
+}
+
+// Edit runs the editor in the terminal that henk runs in.
+func (ui *PlainUI) Edit(text string) (string, error) {
+	cmd, path, err := editorCommand(text)
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return readEdited(path)
+}
+
+func (ui *PlainUI) SetStatus(status string) {}
+
+func (ui *PlainUI) Close() {
+	ui.cancel()
+}
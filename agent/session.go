@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Session is a conversation as it is stored on disk.
+type Session struct {
+	ID           string        `json:"id"`
+	Created      time.Time     `json:"created"`
+	Conversation *Conversation `json:"conversation"`
+}
+
+// NewSession starts an empty session. The id starts with the time, so that
+// sessions sort in order, and ends with a random part, so that sessions that
+// start in the same second do not overwrite each other.
+func NewSession() *Session {
+	now := time.Now()
+	b := make([]byte, 2)
+	rand.Read(b)
+	return &Session{
+		ID:           fmt.Sprintf("%s-%x", now.Format("20060102-150405"), b),
+		Created:      now,
+		Conversation: NewConversation(),
+	}
+}
+
+func (s *Session) Save() error {
+	dir, err := sessionDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal session: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, s.ID+".json"), data, 0600); err != nil {
+		return fmt.Errorf("could not write session: %v", err)
+	}
+
+	return nil
+}
+
+func LoadSession(id string) (*Session, error) {
+	// the id is used as file name, it must not point outside the session dir
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("invalid session id %q", id)
+	}
+	dir, err := sessionDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read session: %v", err)
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("could not parse session: %v", err)
+	}
+	if s.Conversation == nil {
+		s.Conversation = NewConversation()
+	}
+	if err := s.Conversation.Validate(); err != nil {
+		return nil, fmt.Errorf("session %s is damaged: %v", id, err)
+	}
+
+	return &s, nil
+}
+
+// ListSessions returns the ids of all stored sessions, oldest first.
+func ListSessions() ([]string, error) {
+	dir, err := sessionDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read session dir: %v", err)
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func sessionDir() (string, error) {
+	configDir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(configDir, "sessions")
+	if err := setupDir(dir); err != nil {
+		return "", fmt.Errorf("could not create session dir: %v", err)
+	}
+
+	return dir, nil
+}
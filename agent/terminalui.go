@@ -0,0 +1,441 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/glamour"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	modeInput  = "input"
+	modeScroll = "scroll"
+
+	inputHeight = 5
+)
+
+// TerminalUI is a full screen interface with a scrollable conversation, a
+// status bar and an input field.
+type TerminalUI struct {
+	program *tea.Program
+	out     chan string
+	edited  chan editorFinishedMsg
+	done    chan struct{}
+	cancel  context.CancelFunc
+}
+
+func NewTerminalUI(cancel context.CancelFunc) *TerminalUI {
+	ui := &TerminalUI{
+		out:    make(chan string),
+		edited: make(chan editorFinishedMsg),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	ui.program = tea.NewProgram(newModel(ui.out, ui.edited), tea.WithAltScreen())
+	go func() {
+		if _, err := ui.program.Run(); err != nil {
+			fmt.Println(err)
+		}
+		close(ui.done)
+		ui.cancel()
+	}()
+
+	return ui
+}
+
+func (ui *TerminalUI) Show(msg Message) { ui.program.Send(msg) }
+
+func (ui *TerminalUI) Prompt(initial string) (string, bool) {
+	ui.program.Send(promptMsg(initial))
+	select {
+	case text := <-ui.out:
+		return text, true
+	case <-ui.done:
+		return "", false
+	}
+}
+
+// Edit suspends the interface while the editor runs.
+func (ui *TerminalUI) Edit(text string) (string, error) {
+	ui.program.Send(editMsg(text))
+	select {
+	case msg := <-ui.edited:
+		return msg.text, msg.err
+	case <-ui.done:
+		return "", errors.New("the interface was closed")
+	}
+}
+
+func (ui *TerminalUI) SetStatus(status string) { ui.program.Send(statusMsg(status)) }
+
+func (ui *TerminalUI) Close() {
+	ui.program.Quit()
+	<-ui.done
+}
+
+type promptMsg string
+type statusMsg string
+type editMsg string
+
+// entry is a message in the conversation as it is shown on screen.
+type entry struct {
+	msgType MessageType
+	id      string
+	body    string
+	result  string
+	done    bool
+	// rendered is the output of render, empty when it needs to be redone
+	rendered string
+}
+
+// editorFinishedMsg is the text from the editor. With reply, it answers a
+// call of Edit, otherwise it goes in the input field.
+type editorFinishedMsg struct {
+	text  string
+	err   error
+	reply bool
+}
+
+type model struct {
+	out       chan string
+	edited    chan editorFinishedMsg
+	entries   []entry
+	viewport  viewport.Model
+	input     textarea.Model
+	spinner   spinner.Model
+	renderer  *glamour.TermRenderer
+	width     int
+	mode      string
+	prompting bool
+	status    string
+	showTools bool
+	history   *history
+	histIdx   int
+	draft     string
+}
+
+func newModel(out chan string, edited chan editorFinishedMsg) *model {
+	ta := textarea.New()
+	ta.Placeholder = "Message Henk..."
+	ta.ShowLineNumbers = false
+	ta.CharLimit = 0
+	ta.MaxHeight = 0
+	ta.KeyMap.InsertNewline = key.NewBinding(key.WithKeys("alt+enter", "ctrl+j"))
+	ta.SetHeight(inputHeight)
+
+	sp := spinner.New()
+	sp.Spinner = spinner.Ellipsis
+
+	hist := loadHistory()
+	return &model{
+		out:      out,
+		edited:   edited,
+		entries:  make([]entry, 0),
+		viewport: viewport.New(0, 0),
+		input:    ta,
+		spinner:  sp,
+		mode:     modeInput,
+		history:  hist,
+		histIdx:  hist.Len(),
+	}
+}
+
+func (m *model) Init() tea.Cmd {
+	return m.spinner.Tick
+}
+
+func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.resize(msg.Width, msg.Height)
+		return m, nil
+	case spinner.TickMsg:
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return m, cmd
+	case promptMsg:
+		m.prompting = true
+		m.input.SetValue(string(msg))
+		m.setMode(modeInput)
+		return m, m.input.Focus()
+	case statusMsg:
+		m.status = string(msg)
+		return m, nil
+	case Message:
+		m.receive(msg)
+		return m, nil
+	case editMsg:
+		return m, m.openEditor(string(msg), true)
+	case editorFinishedMsg:
+		if msg.reply {
+			edited := m.edited
+			return m, func() tea.Msg {
+				edited <- msg
+				return nil
+			}
+		}
+		if msg.err != nil {
+			m.addEntry(entry{msgType: TypeError, body: fmt.Sprintf("could not run editor: %v", msg.err)})
+			return m, nil
+		}
+		m.input.SetValue(msg.text)
+		return m, nil
+	case tea.KeyMsg:
+		return m, m.handleKey(msg)
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+func (m *model) receive(msg Message) {
+	switch msg.Type {
+	case TypeToolResult:
+		for i := len(m.entries) - 1; i >= 0; i-- {
+			if m.entries[i].msgType == TypeTool && m.entries[i].id == msg.ID {
+				m.entries[i].result = msg.Body
+				m.entries[i].done = true
+				m.entries[i].rendered = ""
+				break
+			}
+		}
+		m.refresh()
+	default:
+		m.addEntry(entry{msgType: msg.Type, id: msg.ID, body: msg.Body})
+	}
+}
+
+func (m *model) handleKey(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "ctrl+c":
+		return tea.Quit
+	case "ctrl+t":
+		m.showTools = !m.showTools
+		m.rerender()
+		return nil
+	case "pgup":
+		m.viewport.PageUp()
+		return nil
+	case "pgdown":
+		m.viewport.PageDown()
+		return nil
+	case "tab", "esc":
+		if m.mode == modeInput {
+			m.setMode(modeScroll)
+		} else {
+			m.setMode(modeInput)
+		}
+		return nil
+	}
+
+	if m.mode == modeScroll {
+		switch msg.String() {
+		case "i", "enter":
+			m.setMode(modeInput)
+			return nil
+		}
+		var cmd tea.Cmd
+		m.viewport, cmd = m.viewport.Update(msg)
+		return cmd
+	}
+
+	switch msg.String() {
+	case "enter":
+		return m.submit()
+	case "ctrl+e":
+		return m.openEditor(m.input.Value(), false)
+	case "up":
+		if m.input.Line() == 0 && m.histIdx > 0 {
+			if m.histIdx == m.history.Len() {
+				m.draft = m.input.Value()
+			}
+			m.histIdx--
+			m.input.SetValue(m.history.Get(m.histIdx))
+			return nil
+		}
+	case "down":
+		if m.input.Line() == m.input.LineCount()-1 && m.histIdx < m.history.Len() {
+			m.histIdx++
+			if m.histIdx == m.history.Len() {
+				m.input.SetValue(m.draft)
+			} else {
+				m.input.SetValue(m.history.Get(m.histIdx))
+			}
+			return nil
+		}
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return cmd
+}
+
+func (m *model) submit() tea.Cmd {
+	text := m.input.Value()
+	if !m.prompting || strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	m.prompting = false
+	m.input.Reset()
+	m.history.Add(text)
+	m.histIdx = m.history.Len()
+	m.draft = ""
+	m.addEntry(entry{msgType: TypeUser, body: text})
+
+	out := m.out
+	return func() tea.Msg {
+		out <- text
+		return nil
+	}
+}
+
+func (m *model) openEditor(text string, reply bool) tea.Cmd {
+	cmd, path, err := editorCommand(text)
+	if err != nil {
+		return func() tea.Msg { return editorFinishedMsg{err: err, reply: reply} }
+	}
+
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		if err != nil {
+			os.Remove(path)
+			return editorFinishedMsg{err: err, reply: reply}
+		}
+		text, err := readEdited(path)
+		return editorFinishedMsg{text: text, err: err, reply: reply}
+	})
+}
+
+func (m *model) setMode(mode string) {
+	m.mode = mode
+	if mode == modeInput {
+		m.input.Focus()
+		return
+	}
+	m.input.Blur()
+}
+
+func (m *model) resize(width, height int) {
+	m.width = width
+	m.input.SetWidth(width)
+	m.viewport.Width = width
+	m.viewport.Height = max(height-inputHeight-2, 1)
+	r, err := glamour.NewTermRenderer(
+		glamour.WithStandardStyle("dark"),
+		glamour.WithWordWrap(width-4),
+	)
+	if err == nil {
+		m.renderer = r
+	}
+	m.rerender()
+}
+
+func (m *model) addEntry(e entry) {
+	m.entries = append(m.entries, e)
+	m.refresh()
+}
+
+// rerender renders all entries again, for when the width or the display of
+// tools changed.
+func (m *model) rerender() {
+	for i := range m.entries {
+		m.entries[i].rendered = ""
+	}
+	m.refresh()
+}
+
+// refresh renders the entries that are new or changed and scrolls to the end
+// if the view was already there.
+func (m *model) refresh() {
+	if m.renderer == nil {
+		return
+	}
+	atBottom := m.viewport.AtBottom()
+
+	var b strings.Builder
+	for i := range m.entries {
+		if m.entries[i].rendered == "" {
+			m.entries[i].rendered = m.render(m.entries[i])
+		}
+		b.WriteString(m.entries[i].rendered)
+	}
+	m.viewport.SetContent(b.String())
+	if atBottom {
+		m.viewport.GotoBottom()
+	}
+}
+
+func (m *model) render(e entry) string {
+	who := sender(e.msgType)
+	body := e.body
+	if e.msgType == TypeThinking {
+		if !m.showTools {
+			body = fmt.Sprintf("%s (ctrl-t to expand)", firstLine(body, m.width))
+		}
+		// the markdown renderer would undo the dimming, so it is not used
+		return thinkingStyle.Width(m.width).Render(fmt.Sprintf("%s: %s", who, body)) + "\n\n"
+	}
+	if e.msgType == TypeTool {
+		state := "done"
+		if !e.done {
+			state = "running..."
+		}
+		switch {
+		case !m.showTools:
+			body = fmt.Sprintf("`%s` %s (ctrl-t to expand)", firstLine(body, m.width), state)
+		case e.result != "":
+			result := truncate(e.result, exportResultLimit)
+			fence := codeFence(result)
+			body = fmt.Sprintf("`%s` %s\n\n%s\n%s\n%s", body, state, fence, result, fence)
+		default:
+			body = fmt.Sprintf("`%s` %s", body, state)
+		}
+	}
+
+	out, err := m.renderer.Render(formatMessage(who, body))
+	if err != nil {
+		return fmt.Sprintf("%s: %s\n", who, body)
+	}
+
+	return out
+}
+
+// firstLine shortens text to its first line, cut to fit in half the width.
+func firstLine(text string, width int) string {
+	line, _, _ := strings.Cut(text, "\n")
+	if limit := max(width/2, 20); utf8.RuneCountInString(line) > limit {
+		line = string([]rune(line)[:limit]) + "..."
+	}
+
+	return line
+}
+
+var (
+	statusStyle   = lipgloss.NewStyle().Reverse(true)
+	thinkingStyle = lipgloss.NewStyle().Faint(true).Padding(0, 2)
+)
+
+func (m *model) View() string {
+	state := "ready"
+	if !m.prompting {
+		state = "busy " + m.spinner.View()
+	}
+	status := fmt.Sprintf(" %s | %s | %s", m.status, m.mode, state)
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		m.viewport.View(),
+		statusStyle.Width(m.width).Render(status),
+		m.input.View(),
+	)
+}
@@ -0,0 +1,105 @@
+package tool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/invopop/jsonschema"
+)
+
+// CommandConfig declares a tool that is implemented by an external program.
+type CommandConfig struct {
+	Name        string `toml:"name"`
+	Description string `toml:"description"`
+	// Schema is the JSON schema of the input. It can be given inline, or in
+	// SchemaFile. Without a schema, any object is accepted.
+	Schema     string        `toml:"schema"`
+	SchemaFile string        `toml:"schema_file"`
+	Command    []string      `toml:"command"`
+	Timeout    time.Duration `toml:"timeout"`
+	Dir        string        `toml:"dir"`
+}
+
+// Command is a tool that runs a program. The input is written as JSON to its
+// stdin, and its stdout is the result. If the program fails, its stderr is
+// returned as the error.
+type Command struct {
+	config      CommandConfig
+	inputSchema *jsonschema.Schema
+}
+
+func NewCommand(config CommandConfig) (*Command, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("tool has no name")
+	}
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("tool %s has no command", config.Name)
+	}
+
+	data := []byte(config.Schema)
+	switch {
+	case config.Schema != "" && config.SchemaFile != "":
+		return nil, fmt.Errorf("tool %s has both a schema and a schema file", config.Name)
+	case config.SchemaFile != "":
+		var err error
+		if data, err = os.ReadFile(config.SchemaFile); err != nil {
+			return nil, fmt.Errorf("could not read schema of tool %s: %v", config.Name, err)
+		}
+	case config.Schema == "":
+		data = []byte(`{"type":"object"}`)
+	}
+	var schema jsonschema.Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("could not parse schema of tool %s: %v", config.Name, err)
+	}
+
+	return &Command{
+		config:      config,
+		inputSchema: &schema,
+	}, nil
+}
+
+func (c *Command) Name() string        { return c.config.Name }
+func (c *Command) Description() string { return c.config.Description }
+func (c *Command) InputSchema() *jsonschema.Schema {
+	return c.inputSchema
+}
+
+func (c *Command) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+	if len(input) == 0 {
+		input = json.RawMessage("{}")
+	}
+
+	cmd := exec.CommandContext(ctx, c.config.Command[0], c.config.Command[1:]...)
+	cmd.Dir = c.config.Dir
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// without this, a child that keeps stdout open would make Run wait after
+	// the context is done
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("%s timed out", c.config.Name)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.New(msg)
+		}
+		return "", err
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,105 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+	schema := `{"type":"object","properties":{"word":{"type":"string"}},"required":["word"],"additionalProperties":false}`
+	schemaFile := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(schemaFile, []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		config    CommandConfig
+		input     string
+		expResult string
+		expErr    string
+	}{
+		{
+			name:      "input on stdin",
+			config:    CommandConfig{Command: []string{"cat"}},
+			input:     `{"word":"hello"}`,
+			expResult: `{"word":"hello"}`,
+		},
+		{
+			name:      "working dir",
+			config:    CommandConfig{Command: []string{"pwd"}, Dir: "/"},
+			expResult: "/\n",
+		},
+		{
+			name:   "stderr on failure",
+			config: CommandConfig{Command: []string{"sh", "-c", "echo it broke >&2; exit 1"}},
+			expErr: "it broke",
+		},
+		{
+			name:   "timeout",
+			config: CommandConfig{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond},
+			expErr: "timed out",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Name = "test"
+			cmd, err := NewCommand(tc.config)
+			if err != nil {
+				t.Fatalf("could not create command: %v", err)
+			}
+			result, err := cmd.Execute(context.Background(), json.RawMessage(tc.input))
+			if tc.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+					t.Errorf("expected error with %q, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tc.expResult {
+				t.Errorf("expected %q, got %q", tc.expResult, result)
+			}
+		})
+	}
+
+	t.Run("child keeps stdout open", func(t *testing.T) {
+		cmd, err := NewCommand(CommandConfig{Name: "test", Command: []string{"sh", "-c", "sleep 5 & wait"}, Timeout: 50 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("could not create command: %v", err)
+		}
+		start := time.Now()
+		if _, err := cmd.Execute(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+		if d := time.Since(start); d > 3*time.Second {
+			t.Errorf("expected the call to stop, it took %s", d)
+		}
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		for _, config := range []CommandConfig{
+			{Name: "inline", Command: []string{"cat"}, Schema: schema},
+			{Name: "file", Command: []string{"cat"}, SchemaFile: schemaFile},
+		} {
+			cmd, err := NewCommand(config)
+			if err != nil {
+				t.Fatalf("%s: could not create command: %v", config.Name, err)
+			}
+			if err := Validate(cmd.InputSchema(), json.RawMessage(`{"word":"x"}`)); err != nil {
+				t.Errorf("%s: expected valid input, got %v", config.Name, err)
+			}
+			if err := Validate(cmd.InputSchema(), json.RawMessage(`{"words":"x"}`)); err == nil || !strings.Contains(err.Error(), "words: unknown property") {
+				t.Errorf("%s: expected unknown property, got %v", config.Name, err)
+			}
+		}
+		if _, err := NewCommand(CommandConfig{Name: "broken", Command: []string{"cat"}, Schema: "{"}); err == nil {
+			t.Errorf("expected error for invalid schema")
+		}
+	})
+}
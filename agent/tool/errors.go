@@ -0,0 +1,127 @@
+package tool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const maxSuggestions = 5
+
+// ErrInvalidInput is returned when the input of a tool call does not match
+// the input schema of the tool.
+var ErrInvalidInput = errors.New("invalid input")
+
+func decodeInput(input json.RawMessage, v any) error {
+	if err := json.Unmarshal(input, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+
+	return nil
+}
+
+// notFoundError explains that path does not exist and suggests paths with a
+// similar name, so that the model can correct itself.
+func notFoundError(path string) error {
+	msg := fmt.Sprintf("%s does not exist", path)
+	if suggestions := suggestPaths(path); len(suggestions) > 0 {
+		msg = fmt.Sprintf("%s, did you mean: %s?", msg, strings.Join(suggestions, ", "))
+	}
+
+	return errors.New(msg)
+}
+
+// suggestPaths looks for entries with a name like that of path, in the
+// closest parent directory that exists.
+func suggestPaths(path string) []string {
+	dir, name := filepath.Split(filepath.Clean(path))
+	for dir != "" && dir != "." {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		dir, name = filepath.Split(filepath.Clean(dir))
+	}
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	type candidate struct {
+		path     string
+		distance int
+	}
+	candidates := make([]candidate, 0)
+	for _, e := range entries {
+		if d, ok := similar(name, e.Name()); ok {
+			p := filepath.Join(dir, e.Name())
+			if e.IsDir() {
+				p += "/"
+			}
+			candidates = append(candidates, candidate{path: p, distance: d})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	suggestions := make([]string, 0, maxSuggestions)
+	for _, c := range candidates {
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+		suggestions = append(suggestions, c.path)
+	}
+
+	return suggestions
+}
+
+// similar tells whether two file names look alike, and how far apart they are.
+func similar(a, b string) (int, bool) {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if a == b {
+		return 0, true
+	}
+	stemA := strings.TrimSuffix(a, filepath.Ext(a))
+	stemB := strings.TrimSuffix(b, filepath.Ext(b))
+	if stemA != "" && stemA == stemB {
+		return 1, true
+	}
+	d := levenshtein(a, b)
+	if d <= max(2, len(a)/3) {
+		return d, true
+	}
+	if len(stemA) >= 3 && strings.Contains(stemB, stemA) {
+		return d, true
+	}
+
+	return 0, false
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(rb)]
+}
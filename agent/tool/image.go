@@ -0,0 +1,67 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// MaxImageSize is the largest image that all providers accept.
+const MaxImageSize = 5 << 20
+
+var imageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// Image is a picture that a tool returns, like a screenshot.
+type Image struct {
+	MediaType string
+	Data      []byte
+}
+
+// Output is the result of a tool that can return images next to the text.
+type Output struct {
+	Text   string
+	Images []Image
+}
+
+// ImageExecutor is implemented by tools that can return images. The agent
+// calls ExecuteImages instead of Execute when the model can look at images.
+type ImageExecutor interface {
+	ExecuteImages(ctx context.Context, input json.RawMessage) (Output, error)
+}
+
+// IsImage tells by the extension whether path is an image.
+func IsImage(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadImage loads an image from disk. The type is taken from the content,
+// not from the name of the file.
+func ReadImage(path string) (Image, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Image{}, err
+	}
+	if info.Size() > MaxImageSize {
+		return Image{}, fmt.Errorf("image is %d KB, the limit is %d KB", info.Size()>>10, MaxImageSize>>10)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Image{}, err
+	}
+	mediaType := http.DetectContentType(data)
+	if !slices.Contains(imageTypes, mediaType) {
+		return Image{}, fmt.Errorf("%s is not a png, jpeg, gif or webp image", path)
+	}
+
+	return Image{MediaType: mediaType, Data: data}, nil
+}
@@ -1,7 +1,10 @@
 package tool
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -32,9 +35,9 @@ func (lf *ListFiles) InputSchema() *jsonschema.Schema {
 	return lf.inputSchema
 }
 
-func (lf *ListFiles) Execute(input json.RawMessage) (string, error) {
+func (lf *ListFiles) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	var listFilesInput ListFilesInput
-	if err := json.Unmarshal(input, &listFilesInput); err != nil {
+	if err := decodeInput(input, &listFilesInput); err != nil {
 		return "", err
 	}
 
@@ -42,12 +45,18 @@ func (lf *ListFiles) Execute(input json.RawMessage) (string, error) {
 	if listFilesInput.Path != "" {
 		dir = listFilesInput.Path
 	}
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return "", notFoundError(dir)
+	}
 
 	var files []string
 	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		relPath, err := filepath.Rel(dir, path)
 		if err != nil {
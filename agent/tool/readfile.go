@@ -1,7 +1,11 @@
 package tool
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 
 	"github.com/invopop/jsonschema"
@@ -24,22 +28,61 @@ func NewReadFile() *ReadFile {
 
 func (rf *ReadFile) Name() string { return "read_file" }
 func (rf *ReadFile) Description() string {
-	return "Read the contents of a given relative file path. Do not use this with directory names."
+	return "Read the contents of a given relative file path. Png, jpeg, gif and webp images are returned as images. Do not use this with directory names."
 }
 func (rf *ReadFile) InputSchema() *jsonschema.Schema {
 	return rf.inputSchema
 }
 
-func (rf *ReadFile) Execute(input json.RawMessage) (string, error) {
+func (rf *ReadFile) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	readFileInput := ReadFileInput{}
-	if err := json.Unmarshal(input, &readFileInput); err != nil {
+	if err := decodeInput(input, &readFileInput); err != nil {
 		return "", err
 	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// images are returned by ExecuteImages, for models that can see
+	if IsImage(readFileInput.Path) {
+		return "", fmt.Errorf("%s is an image, and the current model can only read text", readFileInput.Path)
+	}
 
 	content, err := os.ReadFile(readFileInput.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", notFoundError(readFileInput.Path)
+	}
 	if err != nil {
 		return "", err
 	}
 
 	return string(content), nil
 }
+
+// ExecuteImages returns image files as images, and other files as text.
+func (rf *ReadFile) ExecuteImages(ctx context.Context, input json.RawMessage) (Output, error) {
+	readFileInput := ReadFileInput{}
+	if err := decodeInput(input, &readFileInput); err != nil {
+		return Output{}, err
+	}
+	if !IsImage(readFileInput.Path) {
+		text, err := rf.Execute(ctx, input)
+		return Output{Text: text}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Output{}, err
+	}
+
+	img, err := ReadImage(readFileInput.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Output{}, notFoundError(readFileInput.Path)
+	}
+	if err != nil {
+		return Output{}, err
+	}
+
+	return Output{
+		Text:   fmt.Sprintf("%s is an image (%s, %d KB)", readFileInput.Path, img.MediaType, len(img.Data)>>10),
+		Images: []Image{img},
+	}, nil
+}
@@ -1,6 +1,7 @@
 package tool
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/invopop/jsonschema"
@@ -10,7 +11,9 @@ type Tool interface {
 	Name() string
 	Description() string
 	InputSchema() *jsonschema.Schema
-	Execute(input json.RawMessage) (string, error)
+	// Execute runs the tool. Tools that take a while should stop when the
+	// context is done.
+	Execute(ctx context.Context, input json.RawMessage) (string, error)
 }
 
 func GenerateSchema(t any) *jsonschema.Schema {
@@ -0,0 +1,261 @@
+package tool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+)
+
+// Problem is a single reason why an input does not match a schema. Path
+// points to the value in the input, like "path" or "files[2].name".
+type Problem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists everything that is wrong with an input, so that the
+// model can fix it in one go.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (ve *ValidationError) Error() string {
+	lines := make([]string, 0, len(ve.Problems))
+	for _, p := range ve.Problems {
+		path := p.Path
+		if path == "" {
+			path = "input"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", path, p.Message))
+	}
+
+	return fmt.Sprintf("%v: %s", ErrInvalidInput, strings.Join(lines, "; "))
+}
+
+func (ve *ValidationError) Unwrap() error { return ErrInvalidInput }
+
+// Validate checks the input against the schema. It supports the parts of JSON
+// schema that are used for tool inputs: types, required and additional
+// properties, enums, constants, lengths, patterns, ranges and combinations.
+func Validate(schema *jsonschema.Schema, input json.RawMessage) error {
+	if schema == nil {
+		return nil
+	}
+	if len(bytes.TrimSpace(input)) == 0 {
+		input = json.RawMessage("{}")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return &ValidationError{Problems: []Problem{{Message: fmt.Sprintf("not valid JSON: %v", err)}}}
+	}
+
+	var v validator
+	v.validate(schema, value, "")
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+
+	return nil
+}
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) add(path, format string, args ...any) {
+	v.problems = append(v.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) validate(s *jsonschema.Schema, value any, path string) {
+	switch {
+	case s == nil, isBoolSchema(s, true):
+		return
+	case isBoolSchema(s, false):
+		v.add(path, "no value allowed")
+		return
+	}
+
+	if s.Type != "" && !hasType(value, s.Type) {
+		v.add(path, "expected %s, got %s", s.Type, typeOf(value))
+		return
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return equal(e, value) }) {
+		v.add(path, "must be one of %s", asJSON(s.Enum))
+	}
+	if s.Const != nil && !equal(s.Const, value) {
+		v.add(path, "must be %s", asJSON(s.Const))
+	}
+
+	for _, sub := range s.AllOf {
+		v.validate(sub, value, path)
+	}
+	if len(s.AnyOf) > 0 && matching(s.AnyOf, value) == 0 {
+		v.add(path, "does not match any of the allowed schemas")
+	}
+	if len(s.OneOf) > 0 && matching(s.OneOf, value) != 1 {
+		v.add(path, "must match exactly one of the allowed schemas")
+	}
+
+	switch val := value.(type) {
+	case map[string]any:
+		v.validateObject(s, val, path)
+	case []any:
+		if s.MinItems != nil && uint64(len(val)) < *s.MinItems {
+			v.add(path, "must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && uint64(len(val)) > *s.MaxItems {
+			v.add(path, "must have at most %d items", *s.MaxItems)
+		}
+		for i, item := range val {
+			v.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case string:
+		length := uint64(len([]rune(val)))
+		if s.MinLength != nil && length < *s.MinLength {
+			v.add(path, "must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			v.add(path, "must be at most %d characters", *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			if re, err := regexp.Compile(s.Pattern); err == nil && !re.MatchString(val) {
+				v.add(path, "must match the pattern %q", s.Pattern)
+			}
+		}
+	case json.Number:
+		n, _ := val.Float64()
+		if minimum, err := s.Minimum.Float64(); err == nil && n < minimum {
+			v.add(path, "must be at least %s", s.Minimum)
+		}
+		if maximum, err := s.Maximum.Float64(); err == nil && n > maximum {
+			v.add(path, "must be at most %s", s.Maximum)
+		}
+	}
+}
+
+func (v *validator) validateObject(s *jsonschema.Schema, obj map[string]any, path string) {
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			v.add(join(path, name), "required property is missing")
+		}
+	}
+
+	known := make([]string, 0)
+	if s.Properties != nil {
+		for pair := s.Properties.Oldest(); pair != nil; pair = pair.Next() {
+			known = append(known, pair.Key)
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if s.Properties != nil {
+			if prop, ok := s.Properties.Get(name); ok {
+				v.validate(prop, obj[name], join(path, name))
+				continue
+			}
+		}
+		if isBoolSchema(s.AdditionalProperties, false) {
+			v.add(join(path, name), "unknown property, allowed properties are: %s", strings.Join(known, ", "))
+			continue
+		}
+		v.validate(s.AdditionalProperties, obj[name], join(path, name))
+	}
+}
+
+func matching(schemas []*jsonschema.Schema, value any) int {
+	count := 0
+	for _, s := range schemas {
+		var sub validator
+		sub.validate(s, value, "")
+		if len(sub.problems) == 0 {
+			count++
+		}
+	}
+
+	return count
+}
+
+// isBoolSchema tells whether s is the schema true or false. Those can only be
+// recognized by their JSON form.
+func isBoolSchema(s *jsonschema.Schema, b bool) bool {
+	if s == nil {
+		return false
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return false
+	}
+
+	return string(data) == fmt.Sprint(b)
+}
+
+func hasType(value any, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	default:
+		return typeOf(value) == t
+	}
+}
+
+func typeOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// equal compares values by their JSON form, so that numbers from the schema
+// and from the input can be compared.
+func equal(a, b any) bool {
+	return asJSON(a) == asJSON(b)
+}
+
+func asJSON(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+
+	return string(data)
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
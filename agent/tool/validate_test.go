@@ -0,0 +1,62 @@
+package tool
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type nested struct {
+		Name string `json:"name"`
+	}
+	type input struct {
+		Path  string   `json:"path"`
+		Mode  string   `json:"mode,omitempty" jsonschema:"enum=read,enum=write"`
+		Count int      `json:"count,omitempty" jsonschema:"minimum=1,maximum=10"`
+		Items []nested `json:"items,omitempty"`
+	}
+	schema := GenerateSchema(input{})
+
+	for _, tc := range []struct {
+		name   string
+		input  string
+		expErr []string
+	}{
+		{name: "valid", input: `{"path":"x","mode":"read","count":3,"items":[{"name":"a"}]}`},
+		{name: "empty input", input: ``, expErr: []string{"path: required property is missing"}},
+		{name: "not json", input: `{"path":`, expErr: []string{"input: not valid JSON"}},
+		{name: "wrong property", input: `{"file":"x"}`, expErr: []string{
+			"path: required property is missing",
+			"file: unknown property, allowed properties are: path, mode, count, items",
+		}},
+		{name: "wrong type", input: `{"path":42}`, expErr: []string{"path: expected string, got number"}},
+		{name: "not an integer", input: `{"path":"x","count":1.5}`, expErr: []string{"count: expected integer, got number"}},
+		{name: "out of range", input: `{"path":"x","count":11}`, expErr: []string{"count: must be at most 10"}},
+		{name: "enum", input: `{"path":"x","mode":"delete"}`, expErr: []string{`mode: must be one of ["read","write"]`}},
+		{name: "nested", input: `{"path":"x","items":[{"name":"a"},{}]}`, expErr: []string{"items[1].name: required property is missing"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(schema, json.RawMessage(tc.input))
+			if len(tc.expErr) == 0 {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			var ve *ValidationError
+			if !errors.As(err, &ve) || !errors.Is(err, ErrInvalidInput) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+			if len(ve.Problems) != len(tc.expErr) {
+				t.Errorf("expected %d problems, got %v", len(tc.expErr), ve.Problems)
+			}
+			for _, exp := range tc.expErr {
+				if !strings.Contains(err.Error(), exp) {
+					t.Errorf("expected %q in %q", exp, err.Error())
+				}
+			}
+		})
+	}
+}
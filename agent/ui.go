@@ -3,108 +3,131 @@ package agent
 import (
 	"context"
 	"fmt"
-	"time"
+	"os"
+	"os/exec"
+	"strings"
 
-	"github.com/briandowns/spinner"
-	"github.com/charmbracelet/glamour"
-	"github.com/charmbracelet/huh"
+	"golang.org/x/term"
 )
 
 type MessageType string
 
 const (
-	TypeGeneral MessageType = "general"
-	TypeHenk    MessageType = "henk"
-	TypeUser    MessageType = "user"
-	TypePrompt  MessageType = "prompt"
-	TypeTool    MessageType = "tool"
-	TypeError   MessageType = "error"
-	TypeDebug   MessageType = "debug"
-	TypeExit    MessageType = "exit"
+	TypeGeneral    MessageType = "general"
+	TypeHenk       MessageType = "henk"
+	TypeThinking   MessageType = "thinking"
+	TypeUser       MessageType = "user"
+	TypeTool       MessageType = "tool"
+	TypeToolResult MessageType = "tool_result"
+	TypeError      MessageType = "error"
+	TypeDebug      MessageType = "debug"
 )
 
 type Message struct {
 	Type MessageType
+	// ID links the result of a tool call to the call. Calls can run
+	// concurrently, so results do not always follow their call.
+	ID   string
 	Body string
 }
 
-type UI struct {
-	conversation []Message
-	in           chan Message
-	out          chan string
-	cancel       context.CancelFunc
-	spinner      *spinner.Spinner
-}
+const (
+	UIAuto     = "auto"
+	UITerminal = "terminal"
+	UIPlain    = "plain"
+)
 
-func NewUI(cancel context.CancelFunc) *UI {
-	sp := spinner.New([]string{"  .  ", "  .. ", "  ..."}, 500*time.Millisecond)
-	sp.FinalMSG = ""
+// UI is how the agent talks to the user.
+type UI interface {
+	// Show displays a message.
+	Show(msg Message)
+	// Prompt asks the user for a message. The text in initial can be edited
+	// by the user. It returns false if the user wants to quit.
+	Prompt(initial string) (string, bool)
+	// Edit opens the text in the editor of the user and returns the result.
+	Edit(text string) (string, error)
+	// SetStatus updates the information about the current state of the agent.
+	SetStatus(status string)
+	// Close ends the interface and cancels the context it was created with.
+	Close()
+}
 
-	ui := &UI{
-		in:      make(chan Message),
-		out:     make(chan string),
-		cancel:  cancel,
-		spinner: sp,
+// NewUI creates the interface of the given kind. With UIAuto, the terminal
+// interface is used when henk runs in a capable terminal, and the plain one
+// otherwise.
+func NewUI(kind string, cancel context.CancelFunc) (UI, error) {
+	if kind == UIAuto {
+		kind = UIPlain
+		if term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("TERM") != "dumb" {
+			kind = UITerminal
+		}
 	}
-	go ui.run()
 
-	return ui
+	switch kind {
+	case UITerminal:
+		return NewTerminalUI(cancel), nil
+	case UIPlain:
+		return NewPlainUI(os.Stdin, os.Stdout, cancel), nil
+	default:
+		return nil, fmt.Errorf("unknown ui %q", kind)
+	}
 }
 
-func (ui *UI) In() chan Message { return ui.in }
-func (ui *UI) Out() chan string { return ui.out }
-
-func (ui *UI) run() {
-	ui.out <- "ui ready"
-	for msg := range ui.in {
-		ui.spinner.Stop()
+// editorCommand writes the text to a temporary file and returns the command
+// that opens it in $EDITOR, or vi, together with the path of the file.
+func editorCommand(text string) (*exec.Cmd, string, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	f, err := os.CreateTemp("", "henk-*.md")
+	if err != nil {
+		return nil, "", err
+	}
+	path := f.Name()
+	_, err = f.WriteString(text)
+	f.Close()
+	if err != nil {
+		os.Remove(path)
+		return nil, "", err
+	}
 
-		if msg.Type == TypePrompt {
-			var result string
-			huh.NewText().
-				CharLimit(400).
-				Value(&result).
-				Run()
-			ui.out <- result
-			msg = Message{Type: TypeUser, Body: result}
-		}
+	return exec.Command(editor, path), path, nil
+}
 
-		var who string
-		switch msg.Type {
-		case TypeGeneral:
-			who = "Agent"
-		case TypeHenk:
-			ui.conversation = append(ui.conversation, msg)
-			who = "Henk"
-		case TypeUser:
-			who = "You"
-		case TypeTool:
-			who = "Tool"
-		case TypeError:
-			who = "Error"
-		case TypeDebug:
-			who = "Debug"
-		case TypeExit:
-			ui.Close()
-			return
-		}
+// readEdited returns the text that was written by the editor, and removes
+// the file.
+func readEdited(path string) (string, error) {
+	defer os.Remove(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
 
-		in := fmt.Sprintf("**%s**: %s", who, msg.Body)
-		out, err := glamour.Render(in, "dark")
-		if err != nil {
-			fmt.Println(err)
-		}
-		fmt.Print(out)
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
 
-		ui.spinner.Start()
-	}
+func formatMessage(who, body string) string {
+	return fmt.Sprintf("**%s**: %s", who, body)
 }
 
-func (ui *UI) Close() {
-	if ui.spinner.Active() {
-		ui.spinner.Stop()
+func sender(t MessageType) string {
+	switch t {
+	case TypeGeneral:
+		return "Agent"
+	case TypeHenk:
+		return "Henk"
+	case TypeThinking:
+		return "Thinking"
+	case TypeUser:
+		return "You"
+	case TypeTool:
+		return "Tool"
+	case TypeError:
+		return "Error"
+	case TypeDebug:
+		return "Debug"
+	default:
+		return ""
 	}
-	ui.cancel()
-	close(ui.in)
-	close(ui.out)
 }
@@ -1,29 +1,49 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"go-mod.ewintr.nl/henk/agent"
 	"go-mod.ewintr.nl/henk/agent/llm"
 	"go-mod.ewintr.nl/henk/agent/tool"
+	"golang.org/x/term"
 )
 
 func main() {
-	config, err := agent.ReadConfig()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if len(os.Args) > 1 {
+		subcommands := map[string]func(args []string) error{
+			"export": export,
+			"models": models,
+			"doctor": doctor,
+			"key":    key,
+		}
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
-	if err := config.Validate(); err != nil {
+
+	uiKind := flag.String("ui", agent.UIAuto, "user interface: auto, terminal or plain")
+	flag.Parse()
+
+	config, err := readConfig()
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
 	prov, ok := config.Provider(config.DefaultProvider)
 	if !ok {
-		fmt.Println("could not find provider %q", config.DefaultProvider)
+		fmt.Printf("could not find provider %q\n", config.DefaultProvider)
 		os.Exit(1)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
@@ -33,10 +53,169 @@ func main() {
 		os.Exit(1)
 	}
 
-	ui := agent.NewUI(cancel)
-	tools := []tool.Tool{tool.NewReadFile(), tool.NewListFiles()}
-	h := agent.New(ctx, config, llmClient, tools, ui.In(), ui.Out())
+	ui, err := agent.NewUI(*uiKind, cancel)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tools, err := loadTools(config.Tools)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	h := agent.New(ctx, config, llmClient, tools, ui)
 	if err := h.Run(); err != nil {
 		fmt.Printf("Error: %s\n", err.Error())
 	}
 }
+
+// loadTools returns the built in tools and the ones that are configured as
+// external commands.
+func loadTools(config agent.ToolsConfig) ([]tool.Tool, error) {
+	tools := []tool.Tool{tool.NewReadFile(), tool.NewListFiles()}
+	names := map[string]bool{}
+	for _, t := range tools {
+		names[t.Name()] = true
+	}
+	for _, cc := range config.Commands {
+		t, err := tool.NewCommand(cc)
+		if err != nil {
+			return nil, err
+		}
+		if names[t.Name()] {
+			return nil, fmt.Errorf("there is already a tool with the name %s", t.Name())
+		}
+		names[t.Name()] = true
+		tools = append(tools, t)
+	}
+
+	return tools, nil
+}
+
+func export(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: henk export <session> [md|html|json] [path]")
+	}
+	session, err := agent.LoadSession(args[0])
+	if err != nil {
+		return err
+	}
+	format, path := agent.ParseExportArgs(args[1:])
+	path, err = session.ExportFile(format, path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("session exported to %s\n", path)
+
+	return nil
+}
+
+func readConfig() (agent.Config, error) {
+	config, err := agent.ReadConfig()
+	if err != nil {
+		return agent.Config{}, err
+	}
+	if err := config.Validate(); err != nil {
+		return agent.Config{}, err
+	}
+
+	return config, nil
+}
+
+// models lists the models that the providers offer, optionally for one
+// provider only.
+func models(args []string) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		p, ok := config.Provider(args[0])
+		if !ok {
+			return fmt.Errorf("could not find provider %q", args[0])
+		}
+		config.Providers = []llm.Provider{p}
+	}
+	fmt.Print(agent.RemoteModels(context.Background(), config))
+
+	return nil
+}
+
+func doctor(args []string) error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if !agent.Doctor(context.Background(), config, os.Stdout) {
+		return fmt.Errorf("some checks failed")
+	}
+
+	return nil
+}
+
+// key manages the keys in the encrypted key store.
+func key(args []string) error {
+	usage := fmt.Errorf("usage: henk key list | set <provider> | remove <provider>")
+	if len(args) == 0 {
+		return usage
+	}
+	store, err := agent.OpenKeyStore()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		providers, err := store.Providers()
+		if err != nil {
+			return err
+		}
+		for _, p := range providers {
+			fmt.Println(p)
+		}
+	case args[0] == "set" && len(args) == 2:
+		value, err := readKey()
+		if err != nil {
+			return err
+		}
+		if err := store.Set(args[1], value); err != nil {
+			return err
+		}
+		fmt.Printf("key for %s stored, set api_key_stored = true for the provider\n", args[1])
+	case args[0] == "remove" && len(args) == 2:
+		if err := store.Set(args[1], ""); err != nil {
+			return err
+		}
+		fmt.Printf("key for %s removed\n", args[1])
+	default:
+		return usage
+	}
+
+	return nil
+}
+
+// readKey reads the key without showing it, or from stdin when that is not a
+// terminal.
+func readKey() (string, error) {
+	var value string
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Print("API key: ")
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		value = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		value = line
+	}
+	if value = strings.TrimSpace(value); value == "" {
+		return "", fmt.Errorf("no key given")
+	}
+
+	return value, nil
+}